@@ -0,0 +1,157 @@
+package live
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaxWindow limits how long the CPU time is kept for each client.
+const MaxWindow = 10 * time.Minute
+
+var (
+	mu      sync.RWMutex
+	clients = make(map[*Client]struct{})
+	closed  bool
+)
+
+// Client receives the CPU time records of one instance as soon as they are reported,
+// and sums them up by SQL digest within a rolling window.
+type Client struct {
+	sync.Mutex
+	instance   string
+	windowSecs uint64
+
+	// cpuTimes[ts][sqlDigest] is the CPU time of the SQL digest at second ts
+	cpuTimes map[uint64]map[string]uint64
+
+	doneCh chan struct{}
+}
+
+type TopItem struct {
+	SQLDigest     string `json:"sql_digest"`
+	SQLText       string `json:"sql_text"`
+	CPUTimeMillis uint64 `json:"cpu_time_millis"`
+}
+
+// Subscribe registers a client for the records of the instance.
+func Subscribe(instance string, window time.Duration) *Client {
+	if window > MaxWindow {
+		window = MaxWindow
+	}
+	c := &Client{
+		instance:   instance,
+		windowSecs: uint64(window / time.Second),
+		cpuTimes:   make(map[uint64]map[string]uint64),
+		doneCh:     make(chan struct{}),
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if closed {
+		close(c.doneCh)
+		return c
+	}
+	clients[c] = struct{}{}
+	return c
+}
+
+func Unsubscribe(c *Client) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := clients[c]; ok {
+		delete(clients, c)
+		close(c.doneCh)
+	}
+}
+
+// Stop disconnects all clients.
+func Stop() {
+	mu.Lock()
+	defer mu.Unlock()
+	for c := range clients {
+		delete(clients, c)
+		close(c.doneCh)
+	}
+	closed = true
+}
+
+// Publish fans the CPU time of a SQL digest out to the clients watching the instance.
+func Publish(instance, sqlDigest string, timestampsMillis []uint64, cpuTimeMillis []uint32) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	for c := range clients {
+		if c.instance == instance {
+			c.add(sqlDigest, timestampsMillis, cpuTimeMillis)
+		}
+	}
+}
+
+// Done is closed when the client is unsubscribed or the service is stopping.
+func (c *Client) Done() <-chan struct{} {
+	return c.doneCh
+}
+
+func (c *Client) add(sqlDigest string, timestampsMillis []uint64, cpuTimeMillis []uint32) {
+	c.Lock()
+	defer c.Unlock()
+
+	startTs := c.startTs(time.Now())
+	for i, tsMillis := range timestampsMillis {
+		ts := tsMillis / 1000
+		if ts <= startTs {
+			continue
+		}
+		m, ok := c.cpuTimes[ts]
+		if !ok {
+			m = make(map[string]uint64)
+			c.cpuTimes[ts] = m
+		}
+		m[sqlDigest] += uint64(cpuTimeMillis[i])
+	}
+}
+
+// Top sums up the CPU time of each SQL digest within the window ending at now, and
+// returns the top N of them, or all of them if top is not positive. The total is the
+// CPU time of all SQL digests within the window.
+func (c *Client) Top(now time.Time, top int) (items []TopItem, total uint64) {
+	c.Lock()
+	startTs := c.startTs(now)
+	sums := make(map[string]uint64)
+	for ts, m := range c.cpuTimes {
+		if ts <= startTs {
+			delete(c.cpuTimes, ts)
+			continue
+		}
+		for sqlDigest, cpu := range m {
+			sums[sqlDigest] += cpu
+		}
+	}
+	c.Unlock()
+
+	items = make([]TopItem, 0, len(sums))
+	for sqlDigest, cpu := range sums {
+		items = append(items, TopItem{SQLDigest: sqlDigest, CPUTimeMillis: cpu})
+		total += cpu
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].CPUTimeMillis != items[j].CPUTimeMillis {
+			return items[i].CPUTimeMillis > items[j].CPUTimeMillis
+		}
+		return items[i].SQLDigest < items[j].SQLDigest
+	})
+	if top > 0 && len(items) > top {
+		items = items[:top]
+	}
+	return
+}
+
+// startTs is the exclusive start of the window ending at now.
+func (c *Client) startTs(now time.Time) uint64 {
+	nowSecs := uint64(now.Unix())
+	if nowSecs < c.windowSecs {
+		return 0
+	}
+	return nowSecs - c.windowSecs
+}
@@ -0,0 +1,37 @@
+package live
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientTop(t *testing.T) {
+	c := Subscribe("tidb-0", 10*time.Second)
+	defer Unsubscribe(c)
+	other := Subscribe("tidb-1", 10*time.Second)
+	defer Unsubscribe(other)
+
+	now := time.Now()
+	nowMillis := uint64(now.Unix()) * 1000
+	Publish("tidb-0", "sql-a", []uint64{nowMillis - 20000, nowMillis - 2000, nowMillis}, []uint32{100, 10, 20})
+	Publish("tidb-0", "sql-b", []uint64{nowMillis - 1000}, []uint32{5})
+	Publish("tidb-0", "sql-c", []uint64{nowMillis}, []uint32{1})
+
+	// the record older than the window is dropped
+	items, total := c.Top(now, 2)
+	require.Equal(t, []TopItem{
+		{SQLDigest: "sql-a", CPUTimeMillis: 30},
+		{SQLDigest: "sql-b", CPUTimeMillis: 5},
+	}, items)
+	require.Equal(t, uint64(36), total)
+
+	// the window moves on
+	items, total = c.Top(now.Add(10*time.Second), 0)
+	require.Empty(t, items)
+	require.Zero(t, total)
+
+	items, _ = other.Top(now, 0)
+	require.Empty(t, items)
+}
@@ -0,0 +1,386 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/component/topsql/store"
+	"github.com/zhongzc/ng_monitoring/utils"
+
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+	"github.com/genjidb/genji/types"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	anomalyTableName = "anomaly"
+
+	anomalyCheckInterval = time.Minute
+	// anomalyWindow is the window whose CPU time is compared with the baseline
+	anomalyWindow = 5 * time.Minute
+	// anomalyMaxWindows limits the windows checked in one round
+	anomalyMaxWindows = 12
+
+	// the baseline of a window is made of the anomalyRecentWindows windows before it, and
+	// the same window of each of the anomalySeasons periods before it
+	anomalyRecentWindows = 12
+	anomalySeasons       = 7
+	anomalySeasonPeriod  = 24 * time.Hour
+	// windows without any records are left out of the baseline, and too short baselines
+	// are not trusted, e.g. just after the first start
+	anomalyMinBaselineWindows = 6
+
+	// anomalyMinScore is the least robust z-score, i.e. (cpu - median) / (1.4826 * MAD),
+	// of an anomaly
+	anomalyMinScore = 5
+	// the CPU time has to exceed the median by at least this much, so that the SQL doing
+	// little work are not reported for small variations
+	anomalyMinSurgeMillis = 1000
+)
+
+var (
+	// anomalyLastTs is the end of the last window checked, only accessed by the detector
+	anomalyLastTs int
+
+	anomalyCloseCh chan struct{}
+	anomalyWG      sync.WaitGroup
+)
+
+// anomaly tells that the CPU time of a SQL digest on an instance surges in the window
+// (ts-window, ts].
+type anomaly struct {
+	instance     string
+	instanceType string
+	sqlDigest    string
+	ts           int
+	windowSecs   int
+	cpuTime      uint64
+	median       float64
+	mad          float64
+	score        float64
+}
+
+// anomalySeries is the CPU time of a SQL digest on an instance by window end.
+type anomalySeries map[uint64]uint64
+
+func initAnomaly() error {
+	stmts := []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id TEXT PRIMARY KEY)", anomalyTableName),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_ts ON %s (ts)", anomalyTableName, anomalyTableName),
+	}
+	for _, stmt := range stmts {
+		if err := documentDB.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func startAnomalyDetector() {
+	anomalyCloseCh = make(chan struct{})
+
+	anomalyWG.Add(1)
+	go utils.GoWithRecovery(func() {
+		defer anomalyWG.Done()
+		doAnomalyLoop(anomalyCloseCh)
+	}, nil)
+}
+
+func stopAnomalyDetector() {
+	if anomalyCloseCh == nil {
+		return
+	}
+	close(anomalyCloseCh)
+	anomalyWG.Wait()
+}
+
+func doAnomalyLoop(closed chan struct{}) {
+	ticker := time.NewTicker(anomalyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			runAnomalyDetection(time.Now())
+		case <-closed:
+			return
+		}
+	}
+}
+
+func runAnomalyDetection(now time.Time) {
+	windowSecs := int(anomalyWindow / time.Second)
+	target := int(now.Add(-rollupDelay).Unix())
+	target -= target % windowSecs
+
+	if anomalyLastTs == 0 {
+		// start from the latest window on startup
+		anomalyLastTs = target - windowSecs
+	}
+	if target <= anomalyLastTs {
+		return
+	}
+	if minLastTs := target - windowSecs*anomalyMaxWindows; anomalyLastTs < minLastTs {
+		anomalyLastTs = minLastTs
+	}
+
+	anomalies, err := detectAnomalies(anomalyLastTs, target, windowSecs)
+	if err == nil {
+		err = saveAnomalies(anomalies)
+	}
+	if err != nil {
+		log.Warn("failed to detect anomalies", zap.Error(err))
+		return
+	}
+	anomalyLastTs = target
+
+	if retentionPeriod := store.RetentionPeriod(); retentionPeriod > 0 {
+		safePointTs := now.Add(-retentionPeriod).Unix()
+		sql := fmt.Sprintf("DELETE FROM %s WHERE ts < ?", anomalyTableName)
+		if err := documentDB.Exec(sql, safePointTs); err != nil {
+			log.Warn("failed to gc anomalies", zap.Error(err))
+		}
+	}
+}
+
+// detectAnomalies checks the windows ending within (lastTs, target]. The instances are
+// checked one by one, so that each of the queries stays within the query limits. An
+// instance refused by the limits is skipped, since retrying it never succeeds.
+func detectAnomalies(lastTs, target, windowSecs int) ([]anomaly, error) {
+	firstTs := lastTs + windowSecs
+	instances, err := fetchLabelValues("instance", rawMetricName, firstTs-windowSecs, target)
+	if err != nil {
+		return nil, err
+	}
+
+	var anomalies []anomaly
+	for _, instance := range instances {
+		found, err := detectInstanceAnomalies(instance, firstTs, target, windowSecs)
+		if err != nil {
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) {
+				return nil, err
+			}
+			log.Warn("skip detecting anomalies of instance", zap.String("instance", instance), zap.Error(err))
+			continue
+		}
+		anomalies = append(anomalies, found...)
+	}
+	return anomalies, nil
+}
+
+// detectInstanceAnomalies checks the windows ending within [firstTs, target] of the
+// instance. The baseline of all the windows is fetched in one query for the recent
+// windows, and one for each season.
+func detectInstanceAnomalies(instance string, firstTs, target, windowSecs int) ([]anomaly, error) {
+	query := cpuTimeQuery{
+		matchers: "instance=" + strconv.Quote(instance),
+		by:       "instance, instance_type, sql_digest",
+		limited:  true,
+	}
+
+	// not put back to the pool, because the series still refer to its values
+	recentResponse := &metricResp{}
+	if err := fetchTimeseriesDB(query, firstTs-anomalyRecentWindows*windowSecs, target-windowSecs, windowSecs, recentResponse); err != nil {
+		return nil, err
+	}
+	recent, recentKnown := toAnomalySeries(recentResponse.Data.Results)
+
+	// seasonal[i] are the windows checked shifted back by i+1 periods
+	periodSecs := int(anomalySeasonPeriod / time.Second)
+	seasonal := make([]map[metricRespDataResultMetric]anomalySeries, anomalySeasons)
+	seasonalKnown := make([]map[uint64]bool, anomalySeasons)
+	for i := range seasonal {
+		offset := (i + 1) * periodSecs
+		seasonalResponse := &metricResp{}
+		err := fetchTimeseriesDBRange(query.build(rawMetricName, windowSecs), firstTs-offset, target-offset, windowSecs, query.limited, seasonalResponse)
+		if err != nil {
+			return nil, err
+		}
+		seasonal[i], seasonalKnown[i] = toAnomalySeries(seasonalResponse.Data.Results)
+	}
+
+	var anomalies []anomaly
+	for ts := firstTs; ts <= target; ts += windowSecs {
+		var baselineTs []uint64
+		for i := 1; i <= anomalyRecentWindows; i++ {
+			if t := uint64(ts - i*windowSecs); recentKnown[t] {
+				baselineTs = append(baselineTs, t)
+			}
+		}
+		var seasons []int
+		for i := range seasonal {
+			if seasonalKnown[i][uint64(ts-(i+1)*periodSecs)] {
+				seasons = append(seasons, i)
+			}
+		}
+
+		for metric, series := range recent {
+			cpu, ok := series[uint64(ts)]
+			if !ok {
+				continue
+			}
+
+			baseline := make([]float64, 0, len(baselineTs)+len(seasons))
+			for _, t := range baselineTs {
+				baseline = append(baseline, float64(series[t]))
+			}
+			for _, i := range seasons {
+				baseline = append(baseline, float64(seasonal[i][metric][uint64(ts-(i+1)*periodSecs)]))
+			}
+
+			median, mad, score, ok := scoreAnomaly(cpu, baseline)
+			if !ok {
+				continue
+			}
+			anomalies = append(anomalies, anomaly{
+				instance:     metric.Instance,
+				instanceType: metric.InstanceType,
+				sqlDigest:    metric.SQLDigest,
+				ts:           ts,
+				windowSecs:   windowSecs,
+				cpuTime:      cpu,
+				median:       median,
+				mad:          mad,
+				score:        score,
+			})
+		}
+	}
+	return anomalies, nil
+}
+
+// toAnomalySeries indexes the CPU time by instance, SQL digest and window end. The
+// windows with any records are known, the SQL digests missing in them consumed nothing.
+func toAnomalySeries(results []metricRespDataResult) (map[metricRespDataResultMetric]anomalySeries, map[uint64]bool) {
+	seriesMap := make(map[metricRespDataResultMetric]anomalySeries, len(results))
+	known := make(map[uint64]bool)
+	for _, r := range results {
+		var ps planSeries
+		appendValues(&ps, r.Values)
+		series, ok := seriesMap[r.Metric]
+		if !ok {
+			series = make(anomalySeries, len(ps.timestampSecs))
+			seriesMap[r.Metric] = series
+		}
+		for i, ts := range ps.timestampSecs {
+			series[ts] += ps.cpuTimeMillis[i]
+			known[ts] = true
+		}
+	}
+	return seriesMap, known
+}
+
+// scoreAnomaly tells whether the CPU time surges over the baseline, by how far it is
+// from the median in units of the MAD scaled to the standard deviation. The MAD is at
+// least 1ms, so that a surge over a flat baseline is still scored.
+func scoreAnomaly(cpuTime uint64, baseline []float64) (median, mad, score float64, ok bool) {
+	if len(baseline) < anomalyMinBaselineWindows {
+		return
+	}
+
+	median = medianOf(baseline)
+	deviations := make([]float64, 0, len(baseline))
+	for _, v := range baseline {
+		deviations = append(deviations, math.Abs(v-median))
+	}
+	mad = medianOf(deviations)
+
+	surge := float64(cpuTime) - median
+	score = surge / (1.4826 * math.Max(mad, 1))
+	ok = surge >= anomalyMinSurgeMillis && score >= anomalyMinScore
+	return
+}
+
+func medianOf(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+func saveAnomalies(anomalies []anomaly) error {
+	if len(anomalies) == 0 {
+		return nil
+	}
+
+	sql := fmt.Sprintf("INSERT INTO %s (id, instance, instance_type, sql_digest, ts, window_secs, "+
+		"cpu_time, median, mad, score) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING", anomalyTableName)
+	return documentDB.Update(func(tx *genji.Tx) error {
+		stmt, err := tx.Prepare(sql)
+		if err != nil {
+			return err
+		}
+		for _, a := range anomalies {
+			id := fmt.Sprintf("%s-%s-%d", a.instance, a.sqlDigest, a.ts)
+			err := stmt.Exec(id, a.instance, a.instanceType, a.sqlDigest, a.ts, a.windowSecs, a.cpuTime, a.median, a.mad, a.score)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Anomalies lists the anomalies detected within [startSecs, endSecs], the latest first.
+// An empty instance or sqlDigest matches all of them.
+func Anomalies(startSecs, endSecs int, instance, sqlDigest string, fill *[]AnomalyItem) error {
+	return documentDB.View(func(tx *genji.Tx) error {
+		sql := fmt.Sprintf("SELECT instance, instance_type, sql_digest, ts, window_secs, cpu_time, median, mad, score "+
+			"FROM %s WHERE ts >= ? AND ts <= ?", anomalyTableName)
+		args := []interface{}{startSecs, endSecs}
+		if len(instance) != 0 {
+			sql += " AND instance = ?"
+			args = append(args, instance)
+		}
+		if len(sqlDigest) != 0 {
+			sql += " AND sql_digest = ?"
+			args = append(args, sqlDigest)
+		}
+		sql += " ORDER BY ts DESC"
+
+		res, err := tx.Query(sql, args...)
+		if err != nil {
+			return err
+		}
+		defer res.Close()
+
+		err = res.Iterate(func(d types.Document) error {
+			var item AnomalyItem
+			err := document.Scan(d,
+				&item.Instance,
+				&item.InstanceType,
+				&item.SQLDigest,
+				&item.TimestampSecs,
+				&item.WindowSecs,
+				&item.CPUTimeMillis,
+				&item.MedianCPUTimeMillis,
+				&item.MADCPUTimeMillis,
+				&item.Score,
+			)
+			if err != nil {
+				return err
+			}
+			*fill = append(*fill, item)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for i := range *fill {
+			item := &(*fill)[i]
+			item.SQLText = lookupSQLText(tx, item.SQLDigest)
+		}
+		return nil
+	})
+}
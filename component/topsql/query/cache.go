@@ -0,0 +1,278 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+)
+
+const (
+	resultCacheMaxEntries = 256
+	// the least recently used entries are evicted once the cached values, about 100 bytes
+	// each, grow beyond this
+	resultCacheMaxPoints = 2 * 1024 * 1024
+	// results larger than this are not cached, so that a single one does not evict all
+	// the others
+	resultCacheMaxEntryPoints = resultCacheMaxPoints / 4
+	// entries not used for this long are evicted
+	resultCacheTTL = 10 * time.Minute
+
+	// the meta caches are cleared when growing beyond this
+	metaCacheMaxEntries = 64 * 1024
+)
+
+var (
+	resultCacheHits   = metrics.NewCounter(`ng_monitoring_topsql_query_cache_hits_total`)
+	resultCacheMisses = metrics.NewCounter(`ng_monitoring_topsql_query_cache_misses_total`)
+
+	resultCacheMu     sync.Mutex
+	resultCache       = make(map[string]*resultCacheEntry)
+	resultCachePoints int
+
+	metaCacheMu   sync.RWMutex
+	sqlMetaCache  = make(map[string]sqlMetaCacheItem)
+	planTextCache = make(map[string]string)
+)
+
+// resultCacheEntry keeps the complete windows of a query, i.e. those ending within
+// [startTs, completeTs]. A window is complete once it ends rollupDelay ago, since then
+// the records reported late should have arrived.
+type resultCacheEntry struct {
+	sync.Mutex
+	key        string
+	startTs    int
+	completeTs int
+	results    []metricRespDataResult
+
+	// guarded by resultCacheMu
+	points   int
+	lastUsed time.Time
+}
+
+type sqlMetaCacheItem struct {
+	sqlText    string
+	isInternal bool
+}
+
+// fetchTimeseriesDBCached is the same as fetchTimeseriesDB, except that the complete
+// windows fetched by the previous requests of the same query and window are reused,
+// and only the rest are fetched. The results share their values with the cache, so
+// metricResponse must not be put back to the pool.
+func fetchTimeseriesDBCached(query cpuTimeQuery, startSecs int, endSecs int, windowSecs int, metricResponse *metricResp) error {
+	// checked before only the tail is fetched on a hit
+	if err := checkQueryRange(query, startSecs, endSecs, windowSecs); err != nil {
+		return err
+	}
+
+	start := startSecs - startSecs%windowSecs
+	end := endSecs - endSecs%windowSecs + windowSecs
+	completeTs := int(time.Now().Add(-rollupDelay).Unix())
+	completeTs -= completeTs % windowSecs
+
+	entry := getResultCacheEntry(fmt.Sprintf("%s/%s/%d", query.matchers, query.by, windowSecs))
+	entry.Lock()
+	defer entry.Unlock()
+
+	if len(entry.results) == 0 || start < entry.startTs || start > entry.completeTs {
+		resultCacheMisses.Inc()
+		if err := fetchTimeseriesDB(query, startSecs, endSecs, windowSecs, metricResponse); err != nil {
+			return err
+		}
+		entry.startTs = start
+		entry.completeTs = minInt(end, completeTs)
+		entry.storeResults(sliceResults(metricResponse.Data.Results, entry.startTs, entry.completeTs))
+		return nil
+	}
+
+	resultCacheHits.Inc()
+	metricResponse.Data.Results = sliceResults(entry.results, start, end)
+	if entry.completeTs >= end {
+		return nil
+	}
+
+	// not put back to the pool, because the merged results still refer to its values
+	newResponse := &metricResp{}
+	if err := fetchTimeseriesDB(query, entry.completeTs+windowSecs, endSecs, windowSecs, newResponse); err != nil {
+		return err
+	}
+	mergeResults(&metricResponse.Data.Results, newResponse.Data.Results)
+
+	// windows before start are dropped, so that the entry of a dashboard moving forward
+	// does not grow without limit
+	results := sliceResults(entry.results, start, entry.completeTs)
+	if newCompleteTs := minInt(end, completeTs); newCompleteTs > entry.completeTs {
+		mergeResults(&results, sliceResults(newResponse.Data.Results, entry.completeTs+windowSecs, newCompleteTs))
+		entry.completeTs = newCompleteTs
+	}
+	entry.startTs = start
+	entry.storeResults(results)
+	return nil
+}
+
+func getResultCacheEntry(key string) *resultCacheEntry {
+	resultCacheMu.Lock()
+	defer resultCacheMu.Unlock()
+
+	now := time.Now()
+	if entry, ok := resultCache[key]; ok {
+		entry.lastUsed = now
+		return entry
+	}
+
+	if len(resultCache) >= resultCacheMaxEntries {
+		evictResultCache(now, nil)
+	}
+
+	entry := &resultCacheEntry{key: key, lastUsed: now}
+	resultCache[key] = entry
+	return entry
+}
+
+// storeResults keeps the results in the entry, or drops them if they are too large to
+// cache, and evicts the other entries once the cache holds too many values. The entry
+// has to be locked.
+func (entry *resultCacheEntry) storeResults(results []metricRespDataResult) {
+	points := 0
+	for _, r := range results {
+		points += len(r.Values)
+	}
+	if points > resultCacheMaxEntryPoints {
+		results, points = nil, 0
+	}
+	entry.results = results
+
+	resultCacheMu.Lock()
+	defer resultCacheMu.Unlock()
+
+	// evicted by the others in the meantime
+	if resultCache[entry.key] != entry {
+		return
+	}
+	resultCachePoints += points - entry.points
+	entry.points = points
+	for resultCachePoints > resultCacheMaxPoints && len(resultCache) > 1 {
+		evictResultCache(time.Now(), entry)
+	}
+}
+
+// evictResultCache removes the expired entries, and then the least recently used one
+// except keep if the cache is still full. resultCacheMu has to be held.
+func evictResultCache(now time.Time, keep *resultCacheEntry) {
+	var lru *resultCacheEntry
+	for k, e := range resultCache {
+		if e == keep {
+			continue
+		}
+		if now.Sub(e.lastUsed) > resultCacheTTL {
+			delete(resultCache, k)
+			resultCachePoints -= e.points
+			continue
+		}
+		if lru == nil || e.lastUsed.Before(lru.lastUsed) {
+			lru = e
+		}
+	}
+	if lru != nil && (len(resultCache) >= resultCacheMaxEntries || resultCachePoints > resultCacheMaxPoints) {
+		delete(resultCache, lru.key)
+		resultCachePoints -= lru.points
+	}
+}
+
+// sliceResults keeps the values within [startTs, endTs] of the results without copying
+// them. The capacity of the values is cut, so appending to them never overwrites the
+// values sliced from.
+func sliceResults(results []metricRespDataResult, startTs, endTs int) []metricRespDataResult {
+	sliced := make([]metricRespDataResult, 0, len(results))
+	for _, r := range results {
+		i := sort.Search(len(r.Values), func(i int) bool { return valueTs(r.Values[i]) >= startTs })
+		j := sort.Search(len(r.Values), func(i int) bool { return valueTs(r.Values[i]) > endTs })
+		if i >= j {
+			continue
+		}
+		sliced = append(sliced, metricRespDataResult{
+			Metric: r.Metric,
+			Values: r.Values[i:j:j],
+		})
+	}
+	return sliced
+}
+
+func valueTs(value metricRespDataResultValue) int {
+	if len(value) == 0 {
+		return 0
+	}
+	ts, _ := value[0].(float64)
+	return int(ts)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// lookupSQLMeta looks up the SQL text and whether the SQL is internal. The meta of a
+// digest never changes once reported, so it is cached after found.
+func lookupSQLMeta(tx *genji.Tx, sqlDigest string) (item sqlMetaCacheItem) {
+	if len(sqlDigest) == 0 {
+		return
+	}
+
+	metaCacheMu.RLock()
+	item, ok := sqlMetaCache[sqlDigest]
+	metaCacheMu.RUnlock()
+	if ok {
+		return
+	}
+
+	r, err := tx.QueryDocument("SELECT sql_text, is_internal FROM sql_digest WHERE digest = ?", sqlDigest)
+	if err != nil {
+		return
+	}
+	if err = document.Scan(r, &item.sqlText, &item.isInternal); err != nil {
+		return sqlMetaCacheItem{}
+	}
+
+	metaCacheMu.Lock()
+	if len(sqlMetaCache) >= metaCacheMaxEntries {
+		sqlMetaCache = make(map[string]sqlMetaCacheItem)
+	}
+	sqlMetaCache[sqlDigest] = item
+	metaCacheMu.Unlock()
+	return
+}
+
+func lookupPlanText(tx *genji.Tx, planDigest string) (planText string) {
+	if len(planDigest) == 0 {
+		return
+	}
+
+	metaCacheMu.RLock()
+	planText, ok := planTextCache[planDigest]
+	metaCacheMu.RUnlock()
+	if ok {
+		return
+	}
+
+	r, err := tx.QueryDocument("SELECT plan_text FROM plan_digest WHERE digest = ?", planDigest)
+	if err != nil {
+		return
+	}
+	if err = document.Scan(r, &planText); err != nil {
+		return ""
+	}
+
+	metaCacheMu.Lock()
+	if len(planTextCache) >= metaCacheMaxEntries {
+		planTextCache = make(map[string]string)
+	}
+	planTextCache[planDigest] = planText
+	metaCacheMu.Unlock()
+	return
+}
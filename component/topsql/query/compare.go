@@ -0,0 +1,138 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/genjidb/genji"
+)
+
+// digestCPUTime is the CPU time of a SQL digest within a range, and of each of its plans.
+type digestCPUTime struct {
+	cpuTime uint64
+	plans   map[string]uint64
+}
+
+// CompareTopSQL compares the CPU time of each SQL digest within range A, [startSecsA, endSecsA],
+// with range B, [startSecsB, endSecsB], on the instance, or on the whole cluster if the instance
+// is empty. The results are sorted by the largest regression from A to B first, and at most top
+// items are kept if top is positive.
+func CompareTopSQL(startSecsA, endSecsA, startSecsB, endSecsB, top int, instance string, fill *[]CompareItem) error {
+	query := cpuTimeQuery{by: "sql_digest, plan_digest", limited: true}
+	if len(instance) != 0 {
+		query.matchers = "instance=" + strconv.Quote(instance)
+	}
+
+	cpuTimesA, err := fetchCPUTimeByPlans(query, startSecsA, endSecsA)
+	if err != nil {
+		return err
+	}
+	cpuTimesB, err := fetchCPUTimeByPlans(query, startSecsB, endSecsB)
+	if err != nil {
+		return err
+	}
+
+	for digest, a := range cpuTimesA {
+		b, ok := cpuTimesB[digest]
+		if !ok {
+			b = &digestCPUTime{}
+		}
+		*fill = append(*fill, compareItem(digest, a, b))
+	}
+	for digest, b := range cpuTimesB {
+		if _, ok := cpuTimesA[digest]; !ok {
+			*fill = append(*fill, compareItem(digest, &digestCPUTime{}, b))
+		}
+	}
+
+	sort.Slice(*fill, func(i, j int) bool {
+		a, b := (*fill)[i], (*fill)[j]
+		if a.DeltaMillis != b.DeltaMillis {
+			return a.DeltaMillis > b.DeltaMillis
+		}
+		return a.SQLDigest < b.SQLDigest
+	})
+	if top > 0 && len(*fill) > top {
+		*fill = (*fill)[:top]
+	}
+
+	return documentDB.View(func(tx *genji.Tx) error {
+		for i := range *fill {
+			(*fill)[i].SQLText = lookupSQLText(tx, (*fill)[i].SQLDigest)
+		}
+		return nil
+	})
+}
+
+// fetchCPUTimeByPlans sums the CPU time of each SQL digest and plan digest within
+// [startSecs, endSecs] with one instant query.
+func fetchCPUTimeByPlans(query cpuTimeQuery, startSecs, endSecs int) (map[string]*digestCPUTime, error) {
+	rangeSecs := endSecs - startSecs
+	if rangeSecs <= 0 {
+		return nil, fmt.Errorf("end should be later than start")
+	}
+	if query.limited {
+		if err := CheckQueryRange(startSecs, endSecs, rangeSecs); err != nil {
+			return nil, err
+		}
+	}
+
+	metricResponse := metricRespP.Get()
+	defer metricRespP.Put(metricResponse)
+
+	if err := fetchTimeseriesDBInstant(query.build(rawMetricName, rangeSecs), endSecs, query.limited, metricResponse); err != nil {
+		return nil, err
+	}
+
+	cpuTimes := make(map[string]*digestCPUTime)
+	for _, r := range metricResponse.Data.Results {
+		if len(r.Value) != 2 {
+			continue
+		}
+		cpu, err := strconv.ParseUint(r.Value[1].(string), 10, 64)
+		if err != nil || cpu == 0 {
+			continue
+		}
+
+		c, ok := cpuTimes[r.Metric.SQLDigest]
+		if !ok {
+			c = &digestCPUTime{plans: make(map[string]uint64)}
+			cpuTimes[r.Metric.SQLDigest] = c
+		}
+		c.cpuTime += cpu
+		c.plans[r.Metric.PlanDigest] += cpu
+	}
+
+	return cpuTimes, nil
+}
+
+func compareItem(sqlDigest string, a, b *digestCPUTime) CompareItem {
+	item := CompareItem{
+		SQLDigest:      sqlDigest,
+		CPUTimeMillisA: a.cpuTime,
+		CPUTimeMillisB: b.cpuTime,
+		DeltaMillis:    int64(b.cpuTime) - int64(a.cpuTime),
+		NewPlans:       []string{},
+		VanishedPlans:  []string{},
+	}
+	if a.cpuTime != 0 {
+		ratio := float64(item.DeltaMillis) / float64(a.cpuTime)
+		item.DeltaRatio = &ratio
+	}
+
+	for planDigest := range b.plans {
+		if _, ok := a.plans[planDigest]; !ok && len(planDigest) != 0 {
+			item.NewPlans = append(item.NewPlans, planDigest)
+		}
+	}
+	for planDigest := range a.plans {
+		if _, ok := b.plans[planDigest]; !ok && len(planDigest) != 0 {
+			item.VanishedPlans = append(item.VanishedPlans, planDigest)
+		}
+	}
+	sort.Strings(item.NewPlans)
+	sort.Strings(item.VanishedPlans)
+
+	return item
+}
@@ -0,0 +1,81 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Export walks through the CPU time of every window, SQL digest and plan digest of the
+// instances, and hands the rows to emit. If instances is empty, all instances known
+// within the range are exported. The instances are fetched one by one, so that only
+// the data of one instance is held in memory at a time.
+func Export(startSecs, endSecs, windowSecs int, instances []string, emit func(row ExportRow) error) error {
+	if len(instances) == 0 {
+		var items []InstanceItem
+		if err := Instances(startSecs, endSecs, "", &items); err != nil {
+			return err
+		}
+		for _, item := range items {
+			instances = append(instances, item.Instance)
+		}
+	}
+
+	for _, instance := range instances {
+		if err := exportInstance(startSecs, endSecs, windowSecs, instance, emit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportInstance(startSecs, endSecs, windowSecs int, instance string, emit func(row ExportRow) error) error {
+	metricResponse := metricRespP.Get()
+	defer metricRespP.Put(metricResponse)
+	query := cpuTimeQuery{
+		matchers: fmt.Sprintf("instance=\"%s\"", instance),
+		by:       "instance_type, sql_digest, plan_digest",
+		limited:  true,
+	}
+	if err := fetchTimeseriesDB(query, startSecs, endSecs, windowSecs, metricResponse); err != nil {
+		return err
+	}
+
+	results := metricResponse.Data.Results
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Metric.SQLDigest != results[j].Metric.SQLDigest {
+			return results[i].Metric.SQLDigest < results[j].Metric.SQLDigest
+		}
+		return results[i].Metric.PlanDigest < results[j].Metric.PlanDigest
+	})
+
+	sqlDigests := make([]string, 0, len(results))
+	for i, r := range results {
+		if i == 0 || r.Metric.SQLDigest != results[i-1].Metric.SQLDigest {
+			sqlDigests = append(sqlDigests, r.Metric.SQLDigest)
+		}
+	}
+	sqlTexts := make(map[string]string, len(sqlDigests))
+	if err := SQLTexts(sqlDigests, sqlTexts); err != nil {
+		return err
+	}
+
+	for _, r := range results {
+		var series planSeries
+		appendValues(&series, r.Values)
+		for i, ts := range series.timestampSecs {
+			err := emit(ExportRow{
+				Instance:      instance,
+				InstanceType:  r.Metric.InstanceType,
+				TimestampSecs: ts,
+				SQLDigest:     r.Metric.SQLDigest,
+				PlanDigest:    r.Metric.PlanDigest,
+				SQLText:       sqlTexts[r.Metric.SQLDigest],
+				CPUTimeMillis: series.cpuTimeMillis[i],
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
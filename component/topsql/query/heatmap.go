@@ -0,0 +1,112 @@
+package query
+
+import (
+	"strconv"
+
+	"github.com/genjidb/genji"
+)
+
+// heatmapBucketSecs are the bucket sizes to pick from, aligned with the rollup steps
+// where possible, so that long ranges are served by the rollups.
+var heatmapBucketSecs = []int{
+	1, 5, 10, 15, 30,
+	60, 120, 300, 600, 900, 1800,
+	3600, 2 * 3600, 3 * 3600, 6 * 3600, 12 * 3600, 24 * 3600,
+}
+
+// Heatmap picks the SQL digests as TopSQL, or as ClusterTopSQL if instance is empty, and
+// lays their CPU time out in a matrix with at most about width buckets per row. The matrix
+// is dense, so top has to be positive, and the cells are bounded by maxQueryPoints.
+func Heatmap(
+	startSecs, endSecs, width, offset, top int,
+	instance, instanceType string,
+	internal InternalFilter,
+	orderBy OrderBy,
+	fill *HeatmapItem,
+) error {
+	if top <= 0 {
+		return limitErrorf("top should be positive")
+	}
+
+	query := cpuTimeQuery{by: "sql_digest, plan_digest", limited: true}
+	switch {
+	case len(instance) != 0:
+		query = cpuTimeQuery{matchers: "instance=" + strconv.Quote(instance), limited: true}
+	case len(instanceType) != 0:
+		query.matchers = "instance_type=" + strconv.Quote(instanceType)
+	}
+
+	bucketSecs := pickHeatmapBucket(startSecs, endSecs, width)
+
+	// the same windows as fetched, see fetchTimeseriesDB
+	start := startSecs - startSecs%bucketSecs
+	end := endSecs - endSecs%bucketSecs + bucketSecs
+	columns := (end-start)/bucketSecs + 1
+
+	// a row for each of the top digests, the others and the total
+	if cells := (top + 2) * columns; top > maxQueryPoints || cells > maxQueryPoints {
+		return limitErrorf("too many cells, %d rows of %d buckets exceed the limit %d, please use a smaller top or width",
+			top+2, columns, maxQueryPoints)
+	}
+
+	sqlGroups := sqlGroupSliceP.Get()
+	defer sqlGroupSliceP.Put(sqlGroups)
+
+	var total TotalCPUTimeItem
+	if _, err := topGroups(query, startSecs, endSecs, bucketSecs, offset, top, internal, orderBy, sqlGroups, &total); err != nil {
+		return err
+	}
+
+	fill.BucketSecs = bucketSecs
+	fill.SQLDigests = total.SQLDigests
+	fill.TimestampSecs = make([]uint64, 0, columns)
+	for ts := start; ts <= end; ts += bucketSecs {
+		fill.TimestampSecs = append(fill.TimestampSecs, uint64(ts))
+	}
+	fill.TotalCPUTimeMillis = make([]uint64, columns)
+	addToColumns(fill.TotalCPUTimeMillis, planSeries{timestampSecs: total.TimestampSecs, cpuTimeMillis: total.CPUTimeMillis}, start, bucketSecs)
+
+	return documentDB.View(func(tx *genji.Tx) error {
+		for _, group := range *sqlGroups {
+			row := HeatmapRow{
+				SQLDigest:     group.sqlDigest,
+				IsOthers:      group.isOthers,
+				IsInternal:    group.isInternal,
+				CPUTimeMillis: make([]uint64, columns),
+			}
+			if !group.isOthers {
+				row.SQLText = lookupSQLText(tx, group.sqlDigest)
+			}
+			for _, series := range group.planSeries {
+				addToColumns(row.CPUTimeMillis, series, start, bucketSecs)
+			}
+			fill.Rows = append(fill.Rows, row)
+		}
+		return nil
+	})
+}
+
+// pickHeatmapBucket picks the smallest bucket that fits the range into width buckets.
+func pickHeatmapBucket(startSecs, endSecs, width int) int {
+	span := endSecs - startSecs
+	if span <= 0 || width <= 0 {
+		return heatmapBucketSecs[0]
+	}
+	minBucketSecs := (span + width - 1) / width
+	for _, bucketSecs := range heatmapBucketSecs {
+		if bucketSecs >= minBucketSecs {
+			return bucketSecs
+		}
+	}
+	const daySecs = 24 * 3600
+	return (minBucketSecs + daySecs - 1) / daySecs * daySecs
+}
+
+func addToColumns(columns []uint64, series planSeries, start, bucketSecs int) {
+	for i, ts := range series.timestampSecs {
+		col := (int(ts) - start) / bucketSecs
+		if col >= 0 && col < len(columns) {
+			columns[col] += series.cpuTimeMillis[i]
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package query
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/utils"
+)
+
+// The limits of the queries served by the API. The background jobs split their queries
+// small enough, and check the responses against the same limits.
+const (
+	maxQueryRange = 31 * 24 * time.Hour
+	// maxQueryWindows is the most windows per series, the same as the default of
+	// `search.maxPointsPerTimeseries` of the timeseries db
+	maxQueryWindows = 30000
+	maxQuerySeries  = 20000
+	maxQueryPoints  = 2000000
+
+	// maxQueryScannedSeries is the most raw series a query of the timeseries db scans,
+	// more than maxQuerySeries since the series of the instances are summed up
+	maxQueryScannedSeries = 5 * maxQuerySeries
+	// maxQueryResponseBytes bounds the response of a limited query while vmselect writes
+	// it, enough for maxQueryPoints points and maxQuerySeries series of labels
+	maxQueryResponseBytes = 64 * 1024 * 1024
+	// response buffers grown beyond this are not put back to the pool
+	maxPooledResponseBytes = 4 * 1024 * 1024
+)
+
+var errResponseTooLarge = errors.New("response too large")
+
+// LimitError tells that a query is refused for exceeding a limit. It is caused by the
+// parameters, so retrying the same query never succeeds.
+type LimitError struct {
+	msg string
+}
+
+func (e *LimitError) Error() string {
+	return e.msg
+}
+
+func limitErrorf(format string, args ...interface{}) error {
+	return &LimitError{msg: fmt.Sprintf(format, args...)}
+}
+
+// limitTimeseriesDB makes vmselect refuse the queries beyond the limits while searching,
+// before any response is built. The flags are read by every search.
+func limitTimeseriesDB() {
+	_ = flag.Set("search.maxPointsPerTimeseries", strconv.Itoa(maxQueryWindows))
+	_ = flag.Set("search.maxUniqueTimeseries", strconv.Itoa(maxQueryScannedSeries))
+}
+
+// limitedRespWriter fails the writes beyond maxQueryResponseBytes, so that vmselect gives
+// up an oversized response instead of having all of it buffered.
+type limitedRespWriter struct {
+	utils.ResponseWriter
+	exceeded bool
+}
+
+func (w *limitedRespWriter) Write(b []byte) (int, error) {
+	if w.exceeded || w.Body.Len()+len(b) > maxQueryResponseBytes {
+		w.exceeded = true
+		return 0, errResponseTooLarge
+	}
+	return w.Body.Write(b)
+}
+
+// CheckQueryRange checks that [startSecs, endSecs] is split into a bounded number of
+// windows of windowSecs.
+func CheckQueryRange(startSecs, endSecs, windowSecs int) error {
+	if windowSecs <= 0 {
+		return limitErrorf("window should be at least 1s")
+	}
+	if endSecs < startSecs {
+		return limitErrorf("end should not be earlier than start")
+	}
+	if rangeSecs := endSecs - startSecs; rangeSecs > int(maxQueryRange/time.Second) {
+		return limitErrorf("range should be at most %s", maxQueryRange)
+	}
+	if windows := (endSecs-startSecs)/windowSecs + 1; windows > maxQueryWindows {
+		return limitErrorf("too many windows, %d windows of %ds, at most %d windows are allowed, please use a larger window",
+			windows, windowSecs, maxQueryWindows)
+	}
+	return nil
+}
+
+// checkQueryRange checks the range of the query if it is limited. The window has to be
+// positive anyway, since the range is aligned to it.
+func checkQueryRange(query cpuTimeQuery, startSecs, endSecs, windowSecs int) error {
+	if query.limited {
+		return CheckQueryRange(startSecs, endSecs, windowSecs)
+	}
+	if windowSecs <= 0 {
+		return fmt.Errorf("window should be positive")
+	}
+	return nil
+}
+
+// checkResponseSize estimates the series and points in a response of the timeseries
+// db before it is decoded, by counting the tokens starting a series and separating two
+// values. The estimation never falls short, since the labels are escaped in JSON.
+func checkResponseSize(body []byte) error {
+	series := bytes.Count(body, []byte(`"metric":`))
+	if series > maxQuerySeries {
+		return limitErrorf("too many series, %d series exceed the limit %d, please narrow down the query", series, maxQuerySeries)
+	}
+	points := bytes.Count(body, []byte("],[")) + series
+	if points > maxQueryPoints {
+		return limitErrorf("too many points, %d points exceed the limit %d, please narrow down the range or use a larger window", points, maxQueryPoints)
+	}
+	return nil
+}
@@ -4,18 +4,134 @@ type TopSQLItem struct {
 	SQLDigest string     `json:"sql_digest"`
 	SQLText   string     `json:"sql_text"`
 	Plans     []PlanItem `json:"plans"`
+
+	// IsOthers is true for the synthetic item that sums up all SQL digests outside top N
+	IsOthers   bool `json:"is_others"`
+	IsInternal bool `json:"is_internal"`
+
+	// CPUTimeShare is the fraction of the total CPU time within the whole range
+	CPUTimeShare float64 `json:"cpu_time_share"`
+}
+
+// TotalCPUTimeItem is the CPU time of all SQL digests per window.
+type TotalCPUTimeItem struct {
+	TimestampSecs []uint64 `json:"timestamp_secs"`
+	CPUTimeMillis []uint64 `json:"cpu_time_millis"`
+	// SQLDigests is the number of SQL digests passing the filter, to page through them
+	SQLDigests int `json:"sql_digests"`
+}
+
+// ExportRow is the CPU time of a plan of a SQL digest on an instance within the window
+// ending at TimestampSecs.
+type ExportRow struct {
+	Instance      string `json:"instance"`
+	InstanceType  string `json:"instance_type"`
+	TimestampSecs uint64 `json:"timestamp_secs"`
+	SQLDigest     string `json:"sql_digest"`
+	PlanDigest    string `json:"plan_digest"`
+	SQLText       string `json:"sql_text"`
+	CPUTimeMillis uint64 `json:"cpu_time_millis"`
+}
+
+// HeatmapItem is the CPU time of the top SQL digests laid out in buckets. The cell of a
+// row at column i is the CPU time within the bucket ending at TimestampSecs[i].
+type HeatmapItem struct {
+	BucketSecs    int          `json:"bucket_secs"`
+	TimestampSecs []uint64     `json:"timestamp_secs"`
+	Rows          []HeatmapRow `json:"rows"`
+	// TotalCPUTimeMillis is the CPU time of all SQL digests in each bucket
+	TotalCPUTimeMillis []uint64 `json:"total_cpu_time_millis"`
+	SQLDigests         int      `json:"sql_digests"`
+}
+
+type HeatmapRow struct {
+	SQLDigest     string   `json:"sql_digest"`
+	SQLText       string   `json:"sql_text"`
+	IsOthers      bool     `json:"is_others"`
+	IsInternal    bool     `json:"is_internal"`
+	CPUTimeMillis []uint64 `json:"cpu_time_millis"`
+}
+
+// AnomalyItem tells that the CPU time of a SQL digest on an instance surges in the window
+// (TimestampSecs-WindowSecs, TimestampSecs], compared with the median of its baseline.
+type AnomalyItem struct {
+	Instance            string  `json:"instance"`
+	InstanceType        string  `json:"instance_type"`
+	SQLDigest           string  `json:"sql_digest"`
+	SQLText             string  `json:"sql_text"`
+	TimestampSecs       uint64  `json:"timestamp_secs"`
+	WindowSecs          int     `json:"window_secs"`
+	CPUTimeMillis       uint64  `json:"cpu_time_millis"`
+	MedianCPUTimeMillis float64 `json:"median_cpu_time_millis"`
+	MADCPUTimeMillis    float64 `json:"mad_cpu_time_millis"`
+	Score               float64 `json:"score"`
 }
 
 type PlanItem struct {
 	PlanDigest    string   `json:"plan_digest"`
 	PlanText      string   `json:"plan_text"`
 	TimestampSecs []uint64 `json:"timestamp_secs"`
-	CPUTimeMillis []uint32 `json:"cpu_time_millis"`
+	CPUTimeMillis []uint64 `json:"cpu_time_millis"`
+}
+
+type SQLDetailItem struct {
+	SQLDigest string            `json:"sql_digest"`
+	SQLText   string            `json:"sql_text"`
+	Plans     []PlanItem        `json:"plans"`
+	Instances []SQLInstanceItem `json:"instances"`
+}
+
+type SQLInstanceItem struct {
+	Instance     string     `json:"instance"`
+	InstanceType string     `json:"instance_type"`
+	Plans        []PlanItem `json:"plans"`
+}
+
+type SQLSearchItem struct {
+	SQLDigest     string `json:"sql_digest"`
+	SQLText       string `json:"sql_text"`
+	CPUTimeMillis uint64 `json:"cpu_time_millis"`
+}
+
+type SQLTextItem struct {
+	SQLDigest string `json:"sql_digest"`
+	SQLText   string `json:"sql_text"`
 }
 
 type InstanceItem struct {
 	Instance     string `json:"instance"`
 	InstanceType string `json:"instance_type"`
+	FirstSeenTs  int64  `json:"first_seen_ts"`
+	LastRecordTs int64  `json:"last_record_ts"`
+	Alive        bool   `json:"alive"`
+}
+
+type CompareItem struct {
+	SQLDigest      string `json:"sql_digest"`
+	SQLText        string `json:"sql_text"`
+	CPUTimeMillisA uint64 `json:"cpu_time_millis_a"`
+	CPUTimeMillisB uint64 `json:"cpu_time_millis_b"`
+	DeltaMillis    int64  `json:"delta_millis"`
+
+	// DeltaRatio is the delta relative to range A, and is null if the SQL is new in range B
+	DeltaRatio    *float64 `json:"delta_ratio"`
+	NewPlans      []string `json:"new_plans"`
+	VanishedPlans []string `json:"vanished_plans"`
+}
+
+type PlanChangeItem struct {
+	SQLDigest     string `json:"sql_digest"`
+	SQLText       string `json:"sql_text"`
+	OldPlanDigest string `json:"old_plan_digest"`
+	OldPlanText   string `json:"old_plan_text"`
+	NewPlanDigest string `json:"new_plan_digest"`
+	NewPlanText   string `json:"new_plan_text"`
+
+	// the new plan takes over in the window ending at TimestampSecs, and the CPU time
+	// of the SQL is compared between the window and its previous one
+	TimestampSecs       uint64 `json:"timestamp_secs"`
+	CPUTimeMillisBefore uint64 `json:"cpu_time_millis_before"`
+	CPUTimeMillisAfter  uint64 `json:"cpu_time_millis_after"`
 }
 
 type metricResp struct {
@@ -31,6 +147,7 @@ type metricRespData struct {
 type metricRespDataResult struct {
 	Metric metricRespDataResultMetric  `json:"metric"`
 	Values []metricRespDataResultValue `json:"values"`
+	Value  metricRespDataResultValue   `json:"value"`
 }
 
 type metricRespDataResultMetric struct {
@@ -0,0 +1,305 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/component/topsql/store"
+	"github.com/zhongzc/ng_monitoring/utils"
+
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+	"github.com/genjidb/genji/types"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	planChangeTableName = "plan_change"
+
+	planChangeCheckInterval = time.Minute
+	// planChangeWindow is the window whose dominant plan is compared with the previous one
+	planChangeWindow = 10 * time.Minute
+	// planChangeMaxWindows limits the windows checked in one round
+	planChangeMaxWindows = 144
+	// planChangeWindowsPerQuery splits the windows checked in one round, so that each
+	// query stays within the query limits
+	planChangeWindowsPerQuery = 12
+	// changes of SQL consuming less CPU time than this in either window are ignored
+	planChangeMinCPUTimeMillis = 1000
+)
+
+var (
+	// planChangeLastTs is the end of the last window checked, only accessed by the detector
+	planChangeLastTs int
+
+	planChangeCloseCh chan struct{}
+	planChangeWG      sync.WaitGroup
+)
+
+// planChange tells that the dominant plan of a SQL digest changed from oldPlanDigest
+// in window (ts-window*2, ts-window] to newPlanDigest in window (ts-window, ts].
+type planChange struct {
+	sqlDigest     string
+	oldPlanDigest string
+	newPlanDigest string
+	ts            int
+	cpuTimeBefore uint64
+	cpuTimeAfter  uint64
+}
+
+func initPlanChange() error {
+	stmts := []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id TEXT PRIMARY KEY)", planChangeTableName),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_ts ON %s (ts)", planChangeTableName, planChangeTableName),
+	}
+	for _, stmt := range stmts {
+		if err := documentDB.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func startPlanChangeDetector() {
+	planChangeCloseCh = make(chan struct{})
+
+	planChangeWG.Add(1)
+	go utils.GoWithRecovery(func() {
+		defer planChangeWG.Done()
+		doPlanChangeLoop(planChangeCloseCh)
+	}, nil)
+}
+
+func stopPlanChangeDetector() {
+	if planChangeCloseCh == nil {
+		return
+	}
+	close(planChangeCloseCh)
+	planChangeWG.Wait()
+}
+
+func doPlanChangeLoop(closed chan struct{}) {
+	ticker := time.NewTicker(planChangeCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			runPlanChangeDetection(time.Now())
+		case <-closed:
+			return
+		}
+	}
+}
+
+func runPlanChangeDetection(now time.Time) {
+	windowSecs := int(planChangeWindow / time.Second)
+	target := int(now.Add(-rollupDelay).Unix())
+	target -= target % windowSecs
+
+	if planChangeLastTs == 0 {
+		// start from the latest window on startup
+		planChangeLastTs = target - windowSecs
+	}
+	if target <= planChangeLastTs {
+		return
+	}
+	if minLastTs := target - windowSecs*planChangeMaxWindows; planChangeLastTs < minLastTs {
+		planChangeLastTs = minLastTs
+	}
+
+	changes, err := detectPlanChanges(planChangeLastTs, target, windowSecs)
+	if err == nil {
+		err = savePlanChanges(changes)
+	}
+	if err != nil {
+		log.Warn("failed to detect plan changes", zap.Error(err))
+		return
+	}
+	planChangeLastTs = target
+
+	if retentionPeriod := store.RetentionPeriod(); retentionPeriod > 0 {
+		safePointTs := now.Add(-retentionPeriod).Unix()
+		sql := fmt.Sprintf("DELETE FROM %s WHERE ts < ?", planChangeTableName)
+		if err := documentDB.Exec(sql, safePointTs); err != nil {
+			log.Warn("failed to gc plan changes", zap.Error(err))
+		}
+	}
+}
+
+// detectPlanChanges finds the plan changes in the windows ending within (lastTs, target].
+// The windows are checked planChangeWindowsPerQuery at a time. Those refused by the query
+// limits are skipped, since retrying them never succeeds.
+func detectPlanChanges(lastTs, target, windowSecs int) ([]planChange, error) {
+	var changes []planChange
+	for from := lastTs; from < target; from += windowSecs * planChangeWindowsPerQuery {
+		to := minInt(from+windowSecs*planChangeWindowsPerQuery, target)
+		found, err := detectPlanChangesWithin(from, to, windowSecs)
+		if err != nil {
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) {
+				return nil, err
+			}
+			log.Warn("skip detecting plan changes", zap.Int("from", from), zap.Int("to", to), zap.Error(err))
+			continue
+		}
+		changes = append(changes, found...)
+	}
+	return changes, nil
+}
+
+func detectPlanChangesWithin(lastTs, target, windowSecs int) ([]planChange, error) {
+	// not put back to the pool, because the groups still refer to its values
+	metricResponse := &metricResp{}
+	query := cpuTimeQuery{by: "sql_digest, plan_digest", limited: true}
+	// the windows ending at lastTs, ..., target, the window ending at lastTs is the
+	// previous one of the first window to check
+	if err := fetchTimeseriesDB(query, lastTs, target-windowSecs, windowSecs, metricResponse); err != nil {
+		return nil, err
+	}
+
+	var groups []sqlGroup
+	groupBySQLDigest(metricResponse.Data.Results, &groups)
+
+	var changes []planChange
+	for _, group := range groups {
+		if len(group.sqlDigest) == 0 || len(group.planSeries) < 2 {
+			continue
+		}
+		changes = append(changes, findPlanChanges(group, windowSecs)...)
+	}
+	return changes, nil
+}
+
+// dominantPlan is the plan taking more than half of the CPU time of a SQL in a window.
+type dominantPlan struct {
+	planDigest    string
+	cpuTime       uint64
+	cpuTimeOfPlan uint64
+}
+
+// findPlanChanges compares the dominant plan of each window with its previous window.
+// A change is only reported when both windows have a dominant plan and the SQL consumes
+// at least planChangeMinCPUTimeMillis in both of them, to avoid reporting SQL switching
+// among plans back and forth, or running only a few times.
+func findPlanChanges(group sqlGroup, windowSecs int) (changes []planChange) {
+	windows := make(map[uint64]*dominantPlan)
+	for _, series := range group.planSeries {
+		for i, ts := range series.timestampSecs {
+			w, ok := windows[ts]
+			if !ok {
+				w = &dominantPlan{}
+				windows[ts] = w
+			}
+			cpu := series.cpuTimeMillis[i]
+			w.cpuTime += cpu
+			if cpu > w.cpuTimeOfPlan {
+				w.planDigest = series.planDigest
+				w.cpuTimeOfPlan = cpu
+			}
+		}
+	}
+
+	dominant := func(w *dominantPlan) bool {
+		return len(w.planDigest) != 0 &&
+			w.cpuTimeOfPlan*2 > w.cpuTime &&
+			w.cpuTime >= planChangeMinCPUTimeMillis
+	}
+
+	for ts, cur := range windows {
+		prev, ok := windows[ts-uint64(windowSecs)]
+		if !ok || !dominant(prev) || !dominant(cur) || prev.planDigest == cur.planDigest {
+			continue
+		}
+		changes = append(changes, planChange{
+			sqlDigest:     group.sqlDigest,
+			oldPlanDigest: prev.planDigest,
+			newPlanDigest: cur.planDigest,
+			ts:            int(ts),
+			cpuTimeBefore: prev.cpuTime,
+			cpuTimeAfter:  cur.cpuTime,
+		})
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].ts < changes[j].ts
+	})
+	return
+}
+
+func savePlanChanges(changes []planChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	sql := fmt.Sprintf("INSERT INTO %s (id, sql_digest, old_plan_digest, new_plan_digest, ts, "+
+		"cpu_time_before, cpu_time_after) VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING", planChangeTableName)
+	return documentDB.Update(func(tx *genji.Tx) error {
+		stmt, err := tx.Prepare(sql)
+		if err != nil {
+			return err
+		}
+		for _, c := range changes {
+			// a SQL digest has at most one change at the end of each window
+			id := fmt.Sprintf("%s-%d", c.sqlDigest, c.ts)
+			err := stmt.Exec(id, c.sqlDigest, c.oldPlanDigest, c.newPlanDigest, c.ts, c.cpuTimeBefore, c.cpuTimeAfter)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PlanChanges lists the plan changes detected within [startSecs, endSecs], the latest first.
+// An empty sqlDigest matches all SQL digests.
+func PlanChanges(startSecs, endSecs int, sqlDigest string, fill *[]PlanChangeItem) error {
+	return documentDB.View(func(tx *genji.Tx) error {
+		sql := fmt.Sprintf("SELECT sql_digest, old_plan_digest, new_plan_digest, ts, cpu_time_before, cpu_time_after "+
+			"FROM %s WHERE ts >= ? AND ts <= ?", planChangeTableName)
+		args := []interface{}{startSecs, endSecs}
+		if len(sqlDigest) != 0 {
+			sql += " AND sql_digest = ?"
+			args = append(args, sqlDigest)
+		}
+		sql += " ORDER BY ts DESC"
+
+		res, err := tx.Query(sql, args...)
+		if err != nil {
+			return err
+		}
+		defer res.Close()
+
+		err = res.Iterate(func(d types.Document) error {
+			var item PlanChangeItem
+			err := document.Scan(d,
+				&item.SQLDigest,
+				&item.OldPlanDigest,
+				&item.NewPlanDigest,
+				&item.TimestampSecs,
+				&item.CPUTimeMillisBefore,
+				&item.CPUTimeMillisAfter,
+			)
+			if err != nil {
+				return err
+			}
+			*fill = append(*fill, item)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for i := range *fill {
+			item := &(*fill)[i]
+			item.SQLText = lookupSQLText(tx, item.SQLDigest)
+			item.OldPlanText = lookupPlanText(tx, item.OldPlanDigest)
+			item.NewPlanText = lookupPlanText(tx, item.NewPlanDigest)
+		}
+		return nil
+	})
+}
@@ -3,9 +3,12 @@ package query
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
+	"sort"
 	"strconv"
 
+	"github.com/zhongzc/ng_monitoring/component/topology"
 	"github.com/zhongzc/ng_monitoring/utils"
 
 	"github.com/genjidb/genji"
@@ -31,103 +34,453 @@ var (
 func Init(vmselectHandler_ http.HandlerFunc, db *genji.DB) {
 	vmselectHandler = vmselectHandler_
 	documentDB = db
+	limitTimeseriesDB()
+
+	if err := initRollup(); err != nil {
+		log.Fatal("failed to initialize rollups", zap.Error(err))
+	}
+	if err := initPlanChange(); err != nil {
+		log.Fatal("failed to initialize plan change detector", zap.Error(err))
+	}
+	if err := initAnomaly(); err != nil {
+		log.Fatal("failed to initialize anomaly detector", zap.Error(err))
+	}
+	startRollup()
+	startPlanChangeDetector()
+	startAnomalyDetector()
 }
 
 func Stop() {
+	stopAnomalyDetector()
+	stopPlanChangeDetector()
+	stopRollup()
+}
+
+// InternalFilter tells whether internal SQL, e.g. statistics and DDL jobs run by TiDB
+// itself, are taken into account when picking the top N SQL digests.
+type InternalFilter int
+
+const (
+	IncludeInternal InternalFilter = iota
+	ExcludeInternal
+	OnlyInternal
+)
+
+// OrderBy tells how SQL digests are ranked when picking the top N.
+type OrderBy int
+
+const (
+	// OrderBySum ranks by the CPU time within the whole range
+	OrderBySum OrderBy = iota
+	// OrderByPeak ranks by the CPU time of the busiest window
+	OrderByPeak
+	// OrderByLatest ranks by the CPU time of the latest window with any records
+	OrderByLatest
+	// OrderByGrowth ranks by how fast the CPU time of the later half of the range grows
+	// over the earlier half. SQL digests absent in the earlier half are taken as if they
+	// consumed 1ms there, so that the new and busy ones come first.
+	OrderByGrowth
+)
 
+// TopSQL ranks the SQL digests of the instance by orderBy, skips the first offset ones
+// and keeps the next top N. The total CPU time of the instance per window, summed up
+// over all SQL digests, is filled into total.
+func TopSQL(
+	startSecs, endSecs, windowSecs, offset, top int,
+	instance string,
+	internal InternalFilter,
+	orderBy OrderBy,
+	fill *[]TopSQLItem,
+	total *TotalCPUTimeItem,
+) error {
+	query := cpuTimeQuery{matchers: fmt.Sprintf("instance=\"%s\"", instance), limited: true}
+	return topSQL(query, startSecs, endSecs, windowSecs, offset, top, internal, orderBy, fill, total)
 }
 
-func TopSQL(startSecs, endSecs, windowSecs, top int, instance string, fill *[]TopSQLItem) error {
-	metricResponse := metricRespP.Get()
-	defer metricRespP.Put(metricResponse)
-	if err := fetchTimeseriesDB(startSecs, endSecs, windowSecs, instance, metricResponse); err != nil {
-		return err
+// ClusterTopSQL sums the CPU time of every SQL digest and plan digest across all
+// instances of the cluster, and ranks the SQL digests of the whole cluster as TopSQL.
+// If instanceType is not empty, only instances of that type are taken into account.
+func ClusterTopSQL(
+	startSecs, endSecs, windowSecs, offset, top int,
+	instanceType string,
+	internal InternalFilter,
+	orderBy OrderBy,
+	fill *[]TopSQLItem,
+	total *TotalCPUTimeItem,
+) error {
+	query := cpuTimeQuery{by: "sql_digest, plan_digest", limited: true}
+	if len(instanceType) != 0 {
+		query.matchers = fmt.Sprintf("instance_type=\"%s\"", instanceType)
 	}
+	return topSQL(query, startSecs, endSecs, windowSecs, offset, top, internal, orderBy, fill, total)
+}
 
+func topSQL(
+	query cpuTimeQuery,
+	startSecs, endSecs, windowSecs, offset, top int,
+	internal InternalFilter,
+	orderBy OrderBy,
+	fill *[]TopSQLItem,
+	total *TotalCPUTimeItem,
+) error {
 	sqlGroups := sqlGroupSliceP.Get()
 	defer sqlGroupSliceP.Put(sqlGroups)
-	if err := topK(metricResponse.Data.Results, top, sqlGroups); err != nil {
+
+	totalCPUTimeSum, err := topGroups(query, startSecs, endSecs, windowSecs, offset, top, internal, orderBy, sqlGroups, total)
+	if err != nil {
+		return err
+	}
+	return fillText(sqlGroups, totalCPUTimeSum, fill)
+}
+
+// topGroups fetches the CPU time of every window, groups it by SQL digest, and keeps
+// the groups picked by the filter and the ranking.
+func topGroups(
+	query cpuTimeQuery,
+	startSecs, endSecs, windowSecs, offset, top int,
+	internal InternalFilter,
+	orderBy OrderBy,
+	sqlGroups *[]sqlGroup,
+	total *TotalCPUTimeItem,
+) (totalCPUTimeSum uint64, err error) {
+	// not put back to the pool, because its values are shared with the cache
+	metricResponse := &metricResp{}
+	if err = fetchTimeseriesDBCached(query, startSecs, endSecs, windowSecs, metricResponse); err != nil {
+		return
+	}
+
+	groupBySQLDigest(metricResponse.Data.Results, sqlGroups)
+
+	// the total is summed up over all SQL digests, before any of them is filtered out
+	var totalSeries planSeries
+	totalSeries, totalCPUTimeSum = sumGroups(*sqlGroups)
+	total.TimestampSecs = totalSeries.timestampSecs
+	total.CPUTimeMillis = totalSeries.cpuTimeMillis
+
+	// filter before picking top N, otherwise the SQL filtered out would take the places
+	if err = filterInternal(sqlGroups, internal); err != nil {
+		return
+	}
+	total.SQLDigests = len(*sqlGroups)
+
+	rankGroups(*sqlGroups, orderBy, startSecs, endSecs)
+	err = keepTopK(sqlGroups, offset, top)
+	return
+}
+
+// SQLDetail fetches the CPU time of one SQL digest, broken down by instance and by
+// plan digest, together with its SQL text and the texts of the plans it used.
+func SQLDetail(startSecs, endSecs, windowSecs int, sqlDigest string, fill *SQLDetailItem) error {
+	metricResponse := metricRespP.Get()
+	defer metricRespP.Put(metricResponse)
+	query := cpuTimeQuery{matchers: fmt.Sprintf("sql_digest=\"%s\"", sqlDigest), limited: true}
+	if err := fetchTimeseriesDB(query, startSecs, endSecs, windowSecs, metricResponse); err != nil {
 		return err
 	}
 
-	return fillText(sqlGroups, fill)
+	fill.SQLDigest = sqlDigest
+
+	instanceIdx := make(map[string]int)
+	seriesByPlan := make(map[string][]planSeries)
+	for _, r := range metricResponse.Data.Results {
+		series := planSeries{planDigest: r.Metric.PlanDigest}
+		appendValues(&series, r.Values)
+		seriesByPlan[series.planDigest] = append(seriesByPlan[series.planDigest], series)
+
+		idx, ok := instanceIdx[r.Metric.Instance]
+		if !ok {
+			idx = len(fill.Instances)
+			instanceIdx[r.Metric.Instance] = idx
+			fill.Instances = append(fill.Instances, SQLInstanceItem{
+				Instance:     r.Metric.Instance,
+				InstanceType: r.Metric.InstanceType,
+			})
+		}
+		fill.Instances[idx].Plans = append(fill.Instances[idx].Plans, PlanItem{
+			PlanDigest:    series.planDigest,
+			TimestampSecs: series.timestampSecs,
+			CPUTimeMillis: series.cpuTimeMillis,
+		})
+	}
+
+	for planDigest, series := range seriesByPlan {
+		sum := sumSeries(series)
+		fill.Plans = append(fill.Plans, PlanItem{
+			PlanDigest:    planDigest,
+			TimestampSecs: sum.timestampSecs,
+			CPUTimeMillis: sum.cpuTimeMillis,
+		})
+	}
+
+	sort.Slice(fill.Instances, func(i, j int) bool {
+		return fill.Instances[i].Instance < fill.Instances[j].Instance
+	})
+	sort.Slice(fill.Plans, func(i, j int) bool {
+		return fill.Plans[i].PlanDigest < fill.Plans[j].PlanDigest
+	})
+
+	return documentDB.View(func(tx *genji.Tx) error {
+		fill.SQLText = lookupSQLText(tx, sqlDigest)
+
+		planTexts := make(map[string]string, len(fill.Plans))
+		for i := range fill.Plans {
+			planText := lookupPlanText(tx, fill.Plans[i].PlanDigest)
+			planTexts[fill.Plans[i].PlanDigest] = planText
+			fill.Plans[i].PlanText = planText
+		}
+		for i := range fill.Instances {
+			plans := fill.Instances[i].Plans
+			for j := range plans {
+				plans[j].PlanText = planTexts[plans[j].PlanDigest]
+			}
+		}
+
+		return nil
+	})
 }
 
-func AllInstances(fill *[]InstanceItem) error {
-	doc, err := documentDB.Query("SELECT instance, instance_type FROM instance")
+// Instances lists the instances seen within [startSecs, endSecs], and marks the ones
+// still in the current topology as alive. An empty instanceType matches all types.
+func Instances(startSecs, endSecs int, instanceType string, fill *[]InstanceItem) error {
+	sql := "SELECT instance, instance_type, first_seen_ts, last_seen_ts, last_record_ts FROM instance"
+	var args []interface{}
+	if len(instanceType) != 0 {
+		sql += " WHERE instance_type = ?"
+		args = append(args, instanceType)
+	}
+
+	doc, err := documentDB.Query(sql, args...)
 	if err != nil {
 		return err
 	}
 	defer doc.Close()
 
+	alive := aliveInstances()
 	return doc.Iterate(func(d types.Document) error {
 		item := InstanceItem{}
 
-		err := document.Scan(d, &item.Instance, &item.InstanceType)
+		var lastSeenTs int64
+		err := document.Scan(d, &item.Instance, &item.InstanceType, &item.FirstSeenTs, &lastSeenTs, &item.LastRecordTs)
 		if err != nil {
 			return err
 		}
+		item.Alive = alive[item.Instance] == item.InstanceType
+
+		// the last seen time is persisted lazily, an alive instance is always seen
+		if item.FirstSeenTs > int64(endSecs) || (!item.Alive && lastSeenTs < int64(startSecs)) {
+			return nil
+		}
 
 		*fill = append(*fill, item)
 		return nil
 	})
 }
 
+// aliveInstances maps the addresses of TiDB and TiKV instances in the current topology
+// to their types. The addresses are the same as the subscriber connects to.
+func aliveInstances() map[string]string {
+	alive := make(map[string]string)
+	for _, comp := range topology.GetCurrentComponent() {
+		switch comp.Name {
+		case topology.ComponentTiDB:
+			alive[fmt.Sprintf("%s:%d", comp.IP, comp.StatusPort)] = comp.Name
+		case topology.ComponentTiKV:
+			alive[fmt.Sprintf("%s:%d", comp.IP, comp.Port)] = comp.Name
+		}
+	}
+	return alive
+}
+
 type planSeries struct {
 	planDigest    string
 	timestampSecs []uint64
-	cpuTimeMillis []uint32
+	cpuTimeMillis []uint64
 }
 
 type sqlGroup struct {
 	sqlDigest  string
 	planSeries []planSeries
-	cpuTimeSum uint32
+	cpuTimeSum uint64
+
+	// isOthers marks the synthetic group that folds all SQL digests outside top N
+	isOthers   bool
+	isInternal bool
+
+	// rank orders the groups when picking the top N, the larger one comes first
+	rank float64
 }
 
-func fetchTimeseriesDB(startSecs int, endSecs int, windowSecs int, instance string, metricResponse *metricResp) error {
-	if vmselectHandler == nil {
-		return fmt.Errorf("empty query handler")
+// cpuTimeQuery sums up the CPU time within each window. The metric name is left out,
+// so that the same query can be run against the rollup series.
+type cpuTimeQuery struct {
+	// label matchers, e.g. `instance="127.0.0.1:10080"`
+	matchers string
+	// if not empty, the series are summed up by these labels
+	by string
+	// if set, the query is refused once it exceeds the limits of the API, see limit.go
+	limited bool
+}
+
+func (q cpuTimeQuery) build(metricName string, windowSecs int) string {
+	selector := metricName
+	if len(q.matchers) != 0 {
+		selector = fmt.Sprintf("%s{%s}", metricName, q.matchers)
 	}
 
-	bufResp := bytesP.Get()
-	header := headerP.Get()
+	query := fmt.Sprintf("sum_over_time(%s[%d])", selector, windowSecs)
+	if len(q.by) != 0 {
+		query = fmt.Sprintf("sum(%s) by (%s)", query, q.by)
+	}
+	return query
+}
 
-	defer bytesP.Put(bufResp)
-	defer headerP.Put(header)
+// fetchTimeseriesDB fetches the CPU time of every window within [startSecs, endSecs].
+// The windows already covered by a rollup series are read from the coarsest one that
+// fits, and the rest are read from the raw series.
+func fetchTimeseriesDB(query cpuTimeQuery, startSecs int, endSecs int, windowSecs int, metricResponse *metricResp) error {
+	if err := checkQueryRange(query, startSecs, endSecs, windowSecs); err != nil {
+		return err
+	}
 
-	query := fmt.Sprintf("sum_over_time(cpu_time{instance=\"%s\"}[%d])", instance, windowSecs)
-	start := strconv.Itoa(startSecs - startSecs%windowSecs)
-	end := strconv.Itoa(endSecs - endSecs%windowSecs + windowSecs)
+	start := startSecs - startSecs%windowSecs
+	end := endSecs - endSecs%windowSecs + windowSecs
+
+	level, split := pickRollupLevel(start, end, windowSecs)
+	if level == nil {
+		return fetchTimeseriesDBRange(query.build(rawMetricName, windowSecs), start, end, windowSecs, query.limited, metricResponse)
+	}
 
+	if err := fetchTimeseriesDBRange(query.build(level.name, windowSecs), start, split, windowSecs, query.limited, metricResponse); err != nil {
+		return err
+	}
+	if split >= end {
+		return nil
+	}
+
+	// not put back to the pool, because the merged results still refer to its values
+	rawResponse := &metricResp{}
+	if err := fetchTimeseriesDBRange(query.build(rawMetricName, windowSecs), split+windowSecs, end, windowSecs, query.limited, rawResponse); err != nil {
+		return err
+	}
+	mergeResults(&metricResponse.Data.Results, rawResponse.Data.Results)
+	return nil
+}
+
+func fetchTimeseriesDBRange(query string, startSecs int, endSecs int, stepSecs int, limited bool, metricResponse *metricResp) error {
 	req, err := http.NewRequest("GET", "/api/v1/query_range", nil)
 	if err != nil {
 		return err
 	}
 	reqQuery := req.URL.Query()
 	reqQuery.Set("query", query)
-	reqQuery.Set("start", start)
-	reqQuery.Set("end", end)
-	reqQuery.Set("step", strconv.Itoa(windowSecs))
+	reqQuery.Set("start", strconv.Itoa(startSecs))
+	reqQuery.Set("end", strconv.Itoa(endSecs))
+	reqQuery.Set("step", strconv.Itoa(stepSecs))
 	req.URL.RawQuery = reqQuery.Encode()
-	req.Header.Set("Accept", "application/json")
 
-	respR := utils.NewRespWriter(bufResp, header)
-	vmselectHandler(&respR, req)
+	return queryTimeseriesDB(req, limited, metricResponse)
+}
 
-	if statusOK := respR.Code >= 200 && respR.Code < 300; !statusOK {
-		log.Warn("failed to fetch timeseries db", zap.String("error", respR.Body.String()))
+// mergeResults appends the values of src to the results with the same labels in dst.
+// The values of src are expected to be later than those in dst.
+func mergeResults(dst *[]metricRespDataResult, src []metricRespDataResult) {
+	idx := make(map[metricRespDataResultMetric]int, len(*dst))
+	for i, r := range *dst {
+		idx[r.Metric] = i
 	}
 
-	return json.Unmarshal(respR.Body.Bytes(), metricResponse)
+	for _, r := range src {
+		if i, ok := idx[r.Metric]; ok {
+			(*dst)[i].Values = append((*dst)[i].Values, r.Values...)
+			continue
+		}
+		idx[r.Metric] = len(*dst)
+		*dst = append(*dst, r)
+	}
 }
 
-func topK(results []metricRespDataResult, top int, sqlGroups *[]sqlGroup) error {
-	groupBySQLDigest(results, sqlGroups)
-	if err := keepTopK(sqlGroups, top); err != nil {
+// fetchTimeseriesDBInstant evaluates an instant query at timeSecs. Each result
+// carries its sample in `Value` instead of `Values`.
+func fetchTimeseriesDBInstant(query string, timeSecs int, limited bool, metricResponse *metricResp) error {
+	req, err := http.NewRequest("GET", "/api/v1/query", nil)
+	if err != nil {
 		return err
 	}
-	return nil
+	reqQuery := req.URL.Query()
+	reqQuery.Set("query", query)
+	reqQuery.Set("time", strconv.Itoa(timeSecs))
+	req.URL.RawQuery = reqQuery.Encode()
+
+	return queryTimeseriesDB(req, limited, metricResponse)
+}
+
+// fetchLabelValues lists the values of the label among the series of the metric within
+// [startSecs, endSecs].
+func fetchLabelValues(label, metricName string, startSecs, endSecs int) ([]string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("/api/v1/label/%s/values", label), nil)
+	if err != nil {
+		return nil, err
+	}
+	reqQuery := req.URL.Query()
+	reqQuery.Set("match[]", metricName)
+	reqQuery.Set("start", strconv.Itoa(startSecs))
+	reqQuery.Set("end", strconv.Itoa(endSecs))
+	req.URL.RawQuery = reqQuery.Encode()
+
+	var resp struct {
+		Data []string `json:"data"`
+	}
+	if err := queryTimeseriesDB(req, false, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+// queryTimeseriesDB runs the request against the timeseries db, and decodes the response
+// into resp. If limited, the response is checked against the limits of the API before
+// it is decoded.
+func queryTimeseriesDB(req *http.Request, limited bool, resp interface{}) error {
+	if vmselectHandler == nil {
+		return fmt.Errorf("empty query handler")
+	}
+
+	bufResp := bytesP.Get()
+	header := headerP.Get()
+
+	defer func() {
+		// the pool would hold the capacity of an oversized response forever
+		if bufResp.Cap() <= maxPooledResponseBytes {
+			bytesP.Put(bufResp)
+		}
+	}()
+	defer headerP.Put(header)
+
+	req.Header.Set("Accept", "application/json")
+
+	respR := limitedRespWriter{ResponseWriter: utils.NewRespWriter(bufResp, header)}
+	if limited {
+		vmselectHandler(&respR, req)
+	} else {
+		vmselectHandler(&respR.ResponseWriter, req)
+	}
+
+	if respR.exceeded {
+		return limitErrorf("the response exceeds %dMiB, please narrow down the query", maxQueryResponseBytes/1024/1024)
+	}
+	// vmselect tells 422 for the queries beyond its limits, see limitTimeseriesDB
+	if respR.Code == http.StatusUnprocessableEntity {
+		return limitErrorf("the query exceeds the limits of the timeseries db: %s", respR.Body.String())
+	}
+	if statusOK := respR.Code >= 200 && respR.Code < 300; !statusOK {
+		return fmt.Errorf("failed to fetch timeseries db: %s", respR.Body.String())
+	}
+	if limited {
+		if err := checkResponseSize(respR.Body.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return json.Unmarshal(respR.Body.Bytes(), resp)
 }
 
 func groupBySQLDigest(resp []metricRespDataResult, target *[]sqlGroup) {
@@ -154,21 +507,7 @@ func groupBySQLDigest(resp []metricRespDataResult, target *[]sqlGroup) {
 			ps = &group.planSeries[len(group.planSeries)-1]
 		}
 
-		for _, value := range r.Values {
-			if len(value) != 2 {
-				continue
-			}
-
-			ts := uint64(value[0].(float64))
-			cpu, err := strconv.ParseUint(value[1].(string), 10, 64)
-			if err != nil {
-				continue
-			}
-
-			group.cpuTimeSum += uint32(cpu)
-			ps.timestampSecs = append(ps.timestampSecs, ts)
-			ps.cpuTimeMillis = append(ps.cpuTimeMillis, uint32(cpu))
-		}
+		group.cpuTimeSum += appendValues(ps, r.Values)
 
 		m[r.Metric.SQLDigest] = group
 	}
@@ -182,58 +521,201 @@ func groupBySQLDigest(resp []metricRespDataResult, target *[]sqlGroup) {
 	}
 }
 
-func keepTopK(groups *[]sqlGroup, top int) error {
-	if top <= 0 || len(*groups) <= top {
+// filterInternal marks the internal SQL digests, and keeps the ones passing the filter.
+// SQL digests without meta yet are taken as not internal.
+func filterInternal(groups *[]sqlGroup, internal InternalFilter) error {
+	return documentDB.View(func(tx *genji.Tx) error {
+		n := 0
+		for _, group := range *groups {
+			group.isInternal = lookupIsInternal(tx, group.sqlDigest)
+			switch {
+			case internal == ExcludeInternal && group.isInternal:
+				continue
+			case internal == OnlyInternal && !group.isInternal:
+				continue
+			}
+			(*groups)[n] = group
+			n++
+		}
+		*groups = (*groups)[:n]
 		return nil
+	})
+}
+
+// rankGroups sets the rank of each group by orderBy.
+func rankGroups(groups []sqlGroup, orderBy OrderBy, startSecs, endSecs int) {
+	var latestTs uint64
+	if orderBy == OrderByLatest {
+		for _, group := range groups {
+			for _, series := range group.planSeries {
+				if n := len(series.timestampSecs); n != 0 && series.timestampSecs[n-1] > latestTs {
+					latestTs = series.timestampSecs[n-1]
+				}
+			}
+		}
+	}
+	midTs := uint64(startSecs + (endSecs-startSecs)/2)
+
+	for i := range groups {
+		group := &groups[i]
+		switch orderBy {
+		case OrderByPeak:
+			var peak uint64
+			for _, cpu := range sumSeries(group.planSeries).cpuTimeMillis {
+				if cpu > peak {
+					peak = cpu
+				}
+			}
+			group.rank = float64(peak)
+		case OrderByLatest:
+			var latest uint64
+			for _, series := range group.planSeries {
+				if n := len(series.timestampSecs); n != 0 && series.timestampSecs[n-1] == latestTs {
+					latest += series.cpuTimeMillis[n-1]
+				}
+			}
+			group.rank = float64(latest)
+		case OrderByGrowth:
+			var earlier, later float64
+			for _, series := range group.planSeries {
+				for j, ts := range series.timestampSecs {
+					if ts <= midTs {
+						earlier += float64(series.cpuTimeMillis[j])
+					} else {
+						later += float64(series.cpuTimeMillis[j])
+					}
+				}
+			}
+			group.rank = (later - earlier) / math.Max(earlier, 1)
+		default:
+			group.rank = float64(group.cpuTimeSum)
+		}
 	}
+}
 
-	if err := quickselect.QuickSelect(TopKSlice{s: *groups}, top); err != nil {
-		return err
+// keepTopK sorts the groups by rank, and keeps the top N of them after skipping the
+// first offset ones. The rest are folded into one group. If top is not positive, all
+// groups after offset are kept.
+func keepTopK(groups *[]sqlGroup, offset, top int) error {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(*groups) {
+		offset = len(*groups)
+	}
+	end := len(*groups)
+	if top > 0 && offset+top < end {
+		end = offset + top
+		if err := quickselect.QuickSelect(TopKSlice{s: *groups}, end); err != nil {
+			return err
+		}
 	}
+	sort.Sort(TopKSlice{s: (*groups)[:end]})
 
-	*groups = (*groups)[:top]
+	if offset == 0 && end == len(*groups) {
+		return nil
+	}
 
+	rest := make([]sqlGroup, 0, len(*groups)-(end-offset))
+	rest = append(rest, (*groups)[:offset]...)
+	rest = append(rest, (*groups)[end:]...)
+	others := foldOthers(rest)
+
+	n := copy(*groups, (*groups)[offset:end])
+	*groups = append((*groups)[:n], others)
 	return nil
 }
 
-func fillText(sqlGroups *[]sqlGroup, fill *[]TopSQLItem) error {
+// foldOthers sums up the CPU time of the given groups window by window, so that
+// the kept groups and the folded one still add up to the total CPU time.
+func foldOthers(groups []sqlGroup) sqlGroup {
+	series, cpuTimeSum := sumGroups(groups)
+	return sqlGroup{
+		planSeries: []planSeries{series},
+		cpuTimeSum: cpuTimeSum,
+		isOthers:   true,
+	}
+}
+
+// sumGroups sums up the CPU time of all plans of the groups window by window.
+func sumGroups(groups []sqlGroup) (sum planSeries, cpuTimeSum uint64) {
+	var series []planSeries
+	for _, group := range groups {
+		series = append(series, group.planSeries...)
+		cpuTimeSum += group.cpuTimeSum
+	}
+	return sumSeries(series), cpuTimeSum
+}
+
+// appendValues parses the values of a vmselect result into the series, and returns
+// the sum of the parsed CPU time.
+func appendValues(series *planSeries, values []metricRespDataResultValue) (cpuTimeSum uint64) {
+	for _, value := range values {
+		if len(value) != 2 {
+			continue
+		}
+
+		ts := uint64(value[0].(float64))
+		cpu, err := strconv.ParseUint(value[1].(string), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		cpuTimeSum += cpu
+		series.timestampSecs = append(series.timestampSecs, ts)
+		series.cpuTimeMillis = append(series.cpuTimeMillis, cpu)
+	}
+	return
+}
+
+// sumSeries sums up the CPU time of several series window by window. The plan digest
+// of the result is left empty.
+func sumSeries(series []planSeries) planSeries {
+	cpuTimeByTs := make(map[uint64]uint64)
+	for _, s := range series {
+		for i, ts := range s.timestampSecs {
+			cpuTimeByTs[ts] += s.cpuTimeMillis[i]
+		}
+	}
+
+	sum := planSeries{
+		timestampSecs: make([]uint64, 0, len(cpuTimeByTs)),
+		cpuTimeMillis: make([]uint64, 0, len(cpuTimeByTs)),
+	}
+	for ts := range cpuTimeByTs {
+		sum.timestampSecs = append(sum.timestampSecs, ts)
+	}
+	sort.Slice(sum.timestampSecs, func(i, j int) bool {
+		return sum.timestampSecs[i] < sum.timestampSecs[j]
+	})
+	for _, ts := range sum.timestampSecs {
+		sum.cpuTimeMillis = append(sum.cpuTimeMillis, cpuTimeByTs[ts])
+	}
+
+	return sum
+}
+
+func fillText(sqlGroups *[]sqlGroup, totalCPUTimeSum uint64, fill *[]TopSQLItem) error {
 	return documentDB.View(func(tx *genji.Tx) error {
 		for _, group := range *sqlGroups {
-			sqlDigest := group.sqlDigest
-			var sqlText string
-
-			if len(sqlDigest) != 0 {
-				r, err := tx.QueryDocument(
-					"SELECT sql_text FROM sql_digest WHERE digest = ?",
-					sqlDigest,
-				)
-				if err == nil {
-					_ = document.Scan(r, &sqlText)
-				}
+			if group.isOthers {
+				item := othersItem(group)
+				item.CPUTimeShare = cpuTimeShare(group.cpuTimeSum, totalCPUTimeSum)
+				*fill = append(*fill, item)
+				continue
 			}
 
 			item := TopSQLItem{
-				SQLDigest: sqlDigest,
-				SQLText:   sqlText,
+				SQLDigest:    group.sqlDigest,
+				SQLText:      lookupSQLText(tx, group.sqlDigest),
+				IsInternal:   group.isInternal,
+				CPUTimeShare: cpuTimeShare(group.cpuTimeSum, totalCPUTimeSum),
 			}
 
 			for _, series := range group.planSeries {
-				planDigest := series.planDigest
-				var planText string
-
-				if len(planDigest) != 0 {
-					r, err := tx.QueryDocument(
-						"SELECT plan_text FROM plan_digest WHERE digest = ?",
-						planDigest,
-					)
-					if err == nil {
-						_ = document.Scan(r, &planText)
-					}
-				}
-
 				item.Plans = append(item.Plans, PlanItem{
-					PlanDigest:    planDigest,
-					PlanText:      planText,
+					PlanDigest:    series.planDigest,
+					PlanText:      lookupPlanText(tx, series.planDigest),
 					TimestampSecs: series.timestampSecs,
 					CPUTimeMillis: series.cpuTimeMillis,
 				})
@@ -246,6 +728,44 @@ func fillText(sqlGroups *[]sqlGroup, fill *[]TopSQLItem) error {
 	})
 }
 
+// SQLTexts looks up the SQL texts of the digests. Digests without meta yet are absent.
+func SQLTexts(sqlDigests []string, fill map[string]string) error {
+	return documentDB.View(func(tx *genji.Tx) error {
+		for _, sqlDigest := range sqlDigests {
+			if sqlText := lookupSQLText(tx, sqlDigest); len(sqlText) != 0 {
+				fill[sqlDigest] = sqlText
+			}
+		}
+		return nil
+	})
+}
+
+func cpuTimeShare(cpuTimeSum, totalCPUTimeSum uint64) float64 {
+	if totalCPUTimeSum == 0 {
+		return 0
+	}
+	return float64(cpuTimeSum) / float64(totalCPUTimeSum)
+}
+
+func lookupSQLText(tx *genji.Tx, sqlDigest string) string {
+	return lookupSQLMeta(tx, sqlDigest).sqlText
+}
+
+func lookupIsInternal(tx *genji.Tx, sqlDigest string) bool {
+	return lookupSQLMeta(tx, sqlDigest).isInternal
+}
+
+func othersItem(group sqlGroup) TopSQLItem {
+	item := TopSQLItem{IsOthers: true}
+	for _, series := range group.planSeries {
+		item.Plans = append(item.Plans, PlanItem{
+			TimestampSecs: series.timestampSecs,
+			CPUTimeMillis: series.cpuTimeMillis,
+		})
+	}
+	return item
+}
+
 type TopKSlice struct {
 	s []sqlGroup
 }
@@ -258,6 +778,9 @@ func (s TopKSlice) Less(i, j int) bool {
 	si := s.s[i]
 	sj := s.s[j]
 
+	if si.rank != sj.rank {
+		return si.rank > sj.rank
+	}
 	if si.cpuTimeSum != sj.cpuTimeSum {
 		return si.cpuTimeSum > sj.cpuTimeSum
 	}
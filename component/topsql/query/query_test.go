@@ -0,0 +1,454 @@
+package query
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/utils"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testResult(instance, sqlDigest, planDigest string, values ...metricRespDataResultValue) metricRespDataResult {
+	return metricRespDataResult{
+		Metric: metricRespDataResultMetric{
+			Instance:   instance,
+			SQLDigest:  sqlDigest,
+			PlanDigest: planDigest,
+		},
+		Values: values,
+	}
+}
+
+func testValue(ts float64, cpu string) metricRespDataResultValue {
+	return metricRespDataResultValue{ts, cpu}
+}
+
+func TestGroupBySQLDigest(t *testing.T) {
+	results := []metricRespDataResult{
+		testResult("tidb-0", "sql-a", "plan-a", testValue(60, "10"), testValue(120, "20")),
+		testResult("tidb-0", "sql-a", "plan-b", testValue(120, "5")),
+		testResult("tidb-0", "sql-b", "plan-c", testValue(60, "1")),
+	}
+
+	var groups []sqlGroup
+	groupBySQLDigest(results, &groups)
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].sqlDigest < groups[j].sqlDigest
+	})
+
+	require.Len(t, groups, 2)
+	require.Equal(t, "sql-a", groups[0].sqlDigest)
+	require.Equal(t, uint64(35), groups[0].cpuTimeSum)
+	require.Len(t, groups[0].planSeries, 2)
+	require.Equal(t, []uint64{60, 120}, groups[0].planSeries[0].timestampSecs)
+	require.Equal(t, []uint64{10, 20}, groups[0].planSeries[0].cpuTimeMillis)
+	require.Equal(t, "sql-b", groups[1].sqlDigest)
+	require.Equal(t, uint64(1), groups[1].cpuTimeSum)
+}
+
+func TestCPUTimeSumBeyondUint32(t *testing.T) {
+	// about two weeks of 4 cores, which exceeds the max of uint32
+	results := []metricRespDataResult{
+		testResult("tidb-0", "sql-a", "plan-a", testValue(604800, "2419200000"), testValue(1209600, "2419200000")),
+		testResult("tidb-0", "sql-b", "plan-b", testValue(1209600, "1")),
+	}
+
+	var groups []sqlGroup
+	groupBySQLDigest(results, &groups)
+	_, total := sumGroups(groups)
+	require.Equal(t, uint64(4838400001), total)
+	for _, group := range groups {
+		require.LessOrEqual(t, cpuTimeShare(group.cpuTimeSum, total), float64(1))
+		if group.sqlDigest == "sql-a" {
+			require.Equal(t, uint64(4838400000), group.cpuTimeSum)
+		}
+	}
+}
+
+func TestKeepTopKFoldsOthers(t *testing.T) {
+	results := []metricRespDataResult{
+		testResult("tidb-0", "sql-a", "plan-a", testValue(60, "100"), testValue(120, "100")),
+		testResult("tidb-0", "sql-b", "plan-b", testValue(60, "50"), testValue(120, "50")),
+		testResult("tidb-0", "sql-c", "plan-c", testValue(60, "3")),
+		testResult("tidb-0", "sql-d", "plan-d", testValue(60, "2"), testValue(180, "4")),
+	}
+
+	var groups []sqlGroup
+	groupBySQLDigest(results, &groups)
+	require.NoError(t, keepTopK(&groups, 0, 2))
+	require.Len(t, groups, 3)
+
+	digests := []string{groups[0].sqlDigest, groups[1].sqlDigest}
+	sort.Strings(digests)
+	require.Equal(t, []string{"sql-a", "sql-b"}, digests)
+
+	others := groups[2]
+	require.True(t, others.isOthers)
+	require.Equal(t, uint64(9), others.cpuTimeSum)
+	require.Len(t, others.planSeries, 1)
+	require.Equal(t, []uint64{60, 180}, others.planSeries[0].timestampSecs)
+	require.Equal(t, []uint64{5, 4}, others.planSeries[0].cpuTimeMillis)
+
+	// nothing to fold when all groups fit in top N
+	groups = groups[:0]
+	groupBySQLDigest(results, &groups)
+	require.NoError(t, keepTopK(&groups, 0, 4))
+	require.Len(t, groups, 4)
+	for _, group := range groups {
+		require.False(t, group.isOthers)
+	}
+}
+
+func TestRankGroups(t *testing.T) {
+	results := []metricRespDataResult{
+		testResult("tidb-0", "sql-a", "plan-a", testValue(60, "100"), testValue(120, "100")),
+		testResult("tidb-0", "sql-b", "plan-b", testValue(60, "50"), testValue(120, "50")),
+		testResult("tidb-0", "sql-c", "plan-c", testValue(60, "3")),
+		testResult("tidb-0", "sql-d", "plan-d", testValue(60, "2"), testValue(180, "4")),
+	}
+	rank := func(orderBy OrderBy, offset, top int) (digests []string) {
+		var groups []sqlGroup
+		groupBySQLDigest(results, &groups)
+		rankGroups(groups, orderBy, 0, 180)
+		require.NoError(t, keepTopK(&groups, offset, top))
+		for _, group := range groups {
+			if group.isOthers {
+				digests = append(digests, "others")
+				continue
+			}
+			digests = append(digests, group.sqlDigest)
+		}
+		return
+	}
+
+	require.Equal(t, []string{"sql-a", "sql-b", "sql-d", "sql-c"}, rank(OrderBySum, 0, 0))
+	require.Equal(t, []string{"sql-a", "sql-b", "sql-d", "sql-c"}, rank(OrderByPeak, 0, 0))
+	// the ties are broken by the total CPU time
+	require.Equal(t, []string{"sql-d", "sql-a", "sql-b", "sql-c"}, rank(OrderByLatest, 0, 0))
+	require.Equal(t, []string{"sql-d", "sql-a", "sql-b", "sql-c"}, rank(OrderByGrowth, 0, 0))
+
+	// the groups before and after the page are folded
+	require.Equal(t, []string{"sql-b", "sql-d", "others"}, rank(OrderBySum, 1, 2))
+	require.Equal(t, []string{"sql-c", "others"}, rank(OrderBySum, 3, 2))
+	require.Equal(t, []string{"others"}, rank(OrderBySum, 10, 2))
+}
+
+func TestPickHeatmapBucket(t *testing.T) {
+	require.Equal(t, 60, pickHeatmapBucket(0, 3600, 60))
+	require.Equal(t, 120, pickHeatmapBucket(0, 3601, 60))
+	require.Equal(t, 120, pickHeatmapBucket(0, 24*3600, 1000))
+	require.Equal(t, 900, pickHeatmapBucket(0, 24*3600, 100))
+	require.Equal(t, 1, pickHeatmapBucket(0, 100, 1000))
+	require.Equal(t, 2*24*3600, pickHeatmapBucket(0, 30*24*3600, 20))
+}
+
+func TestPickRollupLevel(t *testing.T) {
+	rollupMu.Lock()
+	rollupMarks = map[string]rollupMark{
+		"cpu_time_1m":  {firstTs: 3600, lastTs: 100 * 3600},
+		"cpu_time_10m": {firstTs: 3600, lastTs: 99 * 3600},
+		"cpu_time_1h":  {firstTs: 10 * 3600, lastTs: 98 * 3600},
+	}
+	rollupMu.Unlock()
+	defer func() {
+		rollupMu.Lock()
+		rollupMarks = nil
+		rollupMu.Unlock()
+	}()
+
+	// the coarsest level dividing the window is preferred
+	level, split := pickRollupLevel(20*3600, 120*3600, 3600)
+	require.Equal(t, "cpu_time_1h", level.name)
+	require.Equal(t, 98*3600, split)
+
+	// the first window starts before the 1h rollup
+	level, split = pickRollupLevel(5*3600, 120*3600, 3600)
+	require.Equal(t, "cpu_time_10m", level.name)
+	require.Equal(t, 99*3600, split)
+
+	// the window is not a multiple of 10m
+	level, split = pickRollupLevel(20*3600, 50*3600, 120)
+	require.Equal(t, "cpu_time_1m", level.name)
+	require.Equal(t, 50*3600, split)
+
+	// windows shorter than any step use the raw series
+	level, _ = pickRollupLevel(20*3600, 50*3600, 30)
+	require.Nil(t, level)
+
+	// everything is later than the rollups
+	level, _ = pickRollupLevel(200*3600, 210*3600, 60)
+	require.Nil(t, level)
+}
+
+func TestMergeResults(t *testing.T) {
+	dst := []metricRespDataResult{
+		testResult("tidb-0", "sql-a", "plan-a", testValue(60, "1")),
+	}
+	src := []metricRespDataResult{
+		testResult("tidb-0", "sql-a", "plan-a", testValue(120, "2")),
+		testResult("tidb-0", "sql-b", "plan-b", testValue(120, "3")),
+	}
+
+	mergeResults(&dst, src)
+	require.Len(t, dst, 2)
+	require.Equal(t, []metricRespDataResultValue{testValue(60, "1"), testValue(120, "2")}, dst[0].Values)
+	require.Equal(t, "sql-b", dst[1].Metric.SQLDigest)
+}
+
+func TestFetchTimeseriesDBCached(t *testing.T) {
+	// the fake vmselect returns CPU time 1 for every window within the requested range
+	var requestedStarts []int
+	vmselectHandler = func(w http.ResponseWriter, r *http.Request) {
+		start, _ := strconv.Atoi(r.URL.Query().Get("start"))
+		end, _ := strconv.Atoi(r.URL.Query().Get("end"))
+		step, _ := strconv.Atoi(r.URL.Query().Get("step"))
+		requestedStarts = append(requestedStarts, start)
+
+		result := testResult("tidb-0", "sql-a", "plan-a")
+		for ts := start; ts <= end; ts += step {
+			result.Values = append(result.Values, testValue(float64(ts), "1"))
+		}
+		resp := metricResp{Status: "success"}
+		resp.Data.Results = []metricRespDataResult{result}
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+	defer func() {
+		vmselectHandler = nil
+		resultCacheMu.Lock()
+		resultCache = make(map[string]*resultCacheEntry)
+		resultCachePoints = 0
+		resultCacheMu.Unlock()
+	}()
+
+	query := cpuTimeQuery{matchers: `instance="tidb-0"`}
+	now := int(time.Now().Unix())
+	start, end := now-3600, now
+
+	first := &metricResp{}
+	require.NoError(t, fetchTimeseriesDBCached(query, start, end, 60, first))
+	require.Equal(t, []int{start - start%60}, requestedStarts)
+
+	// only the windows not complete yet are fetched again
+	entry := getResultCacheEntry(`instance="tidb-0"//60`)
+	completeTs := entry.completeTs
+	second := &metricResp{}
+	require.NoError(t, fetchTimeseriesDBCached(query, start, end, 60, second))
+	require.Equal(t, []int{start - start%60, completeTs + 60}, requestedStarts)
+	require.Equal(t, first.Data.Results, second.Data.Results)
+
+	// the windows before the start moving forward are dropped
+	third := &metricResp{}
+	require.NoError(t, fetchTimeseriesDBCached(query, start+600, end, 60, third))
+	require.Len(t, requestedStarts, 3)
+	require.Equal(t, second.Data.Results[0].Values[10:], third.Data.Results[0].Values)
+	require.Equal(t, start+600-(start+600)%60, entry.startTs)
+	require.Equal(t, len(entry.results[0].Values), resultCachePoints)
+}
+
+func TestResultCacheEviction(t *testing.T) {
+	defer func() {
+		resultCacheMu.Lock()
+		resultCache = make(map[string]*resultCacheEntry)
+		resultCachePoints = 0
+		resultCacheMu.Unlock()
+	}()
+
+	values := make([]metricRespDataResultValue, resultCacheMaxEntryPoints+1)
+	store := func(key string, points int) *resultCacheEntry {
+		entry := getResultCacheEntry(key)
+		entry.Lock()
+		entry.storeResults([]metricRespDataResult{{Values: values[:points]}})
+		entry.Unlock()
+		return entry
+	}
+
+	// the least recently used entry is evicted once the cache is full of points
+	for _, key := range []string{"a", "b", "c", "d"} {
+		store(key, resultCacheMaxEntryPoints)
+	}
+	require.Equal(t, resultCacheMaxPoints, resultCachePoints)
+	store("e", resultCacheMaxEntryPoints)
+	require.NotContains(t, resultCache, "a")
+	require.Len(t, resultCache, 4)
+	require.Equal(t, resultCacheMaxPoints, resultCachePoints)
+
+	// too large results are not cached
+	entry := store("e", resultCacheMaxEntryPoints+1)
+	require.Nil(t, entry.results)
+	require.Equal(t, resultCacheMaxPoints-resultCacheMaxEntryPoints, resultCachePoints)
+}
+
+func TestRollupRetrySkipsInstancesDone(t *testing.T) {
+	// the fake vmselect knows instances a and b, and fails the first query of b
+	var queried []string
+	failB := true
+	vmselectHandler = func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/query_range" {
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "data": []string{"a", "b"}})
+			return
+		}
+		query := r.URL.Query().Get("query")
+		queried = append(queried, query)
+		if failB && strings.Contains(query, `"b"`) {
+			failB = false
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(metricResp{Status: "success"})
+	}
+	defer func() {
+		vmselectHandler = nil
+		rollupProgresses = make(map[string]*rollupProgress)
+	}()
+
+	level := rollupLevels[0]
+	require.Error(t, rollup(level, 600, 1200))
+	require.Len(t, queried, 2)
+
+	// the retry of the same range only rolls up b
+	require.NoError(t, rollup(level, 600, 1200))
+	require.Len(t, queried, 3)
+	require.Contains(t, queried[2], `"b"`)
+	require.Empty(t, rollupProgresses)
+}
+
+func TestCompareItem(t *testing.T) {
+	a := &digestCPUTime{cpuTime: 100, plans: map[string]uint64{"plan-a": 60, "plan-b": 40}}
+	b := &digestCPUTime{cpuTime: 250, plans: map[string]uint64{"plan-b": 50, "plan-c": 200}}
+
+	item := compareItem("sql-a", a, b)
+	require.Equal(t, int64(150), item.DeltaMillis)
+	require.NotNil(t, item.DeltaRatio)
+	require.Equal(t, 1.5, *item.DeltaRatio)
+	require.Equal(t, []string{"plan-c"}, item.NewPlans)
+	require.Equal(t, []string{"plan-a"}, item.VanishedPlans)
+
+	// the SQL is new in range B
+	item = compareItem("sql-b", &digestCPUTime{}, b)
+	require.Equal(t, int64(250), item.DeltaMillis)
+	require.Nil(t, item.DeltaRatio)
+	require.Equal(t, []string{"plan-b", "plan-c"}, item.NewPlans)
+}
+
+func TestFindPlanChanges(t *testing.T) {
+	group := sqlGroup{
+		sqlDigest: "sql-a",
+		planSeries: []planSeries{
+			{planDigest: "plan-a", timestampSecs: []uint64{60, 120, 180, 240}, cpuTimeMillis: []uint64{2000, 2000, 100, 1000}},
+			{planDigest: "plan-b", timestampSecs: []uint64{120, 180, 240}, cpuTimeMillis: []uint64{100, 3000, 1400}},
+		},
+	}
+
+	changes := findPlanChanges(group, 60)
+	require.Len(t, changes, 1)
+	require.Equal(t, planChange{
+		sqlDigest:     "sql-a",
+		oldPlanDigest: "plan-a",
+		newPlanDigest: "plan-b",
+		ts:            180,
+		cpuTimeBefore: 2100,
+		cpuTimeAfter:  3100,
+	}, changes[0])
+
+	// windows without a dominant plan, or with little CPU time, are ignored
+	group.planSeries[1].cpuTimeMillis = []uint64{100, 500, 1400}
+	require.Empty(t, findPlanChanges(group, 60))
+}
+
+func TestDetectPlanChangesInChunks(t *testing.T) {
+	// the fake vmselect serves sql-a with plan-a until 7200, and plan-b after it
+	var ranges [][2]int
+	vmselectHandler = func(w http.ResponseWriter, r *http.Request) {
+		start, _ := strconv.Atoi(r.URL.Query().Get("start"))
+		end, _ := strconv.Atoi(r.URL.Query().Get("end"))
+		step, _ := strconv.Atoi(r.URL.Query().Get("step"))
+		ranges = append(ranges, [2]int{start, end})
+
+		planA, planB := testResult("", "sql-a", "plan-a"), testResult("", "sql-a", "plan-b")
+		for ts := start; ts <= end; ts += step {
+			if ts <= 7200 {
+				planA.Values = append(planA.Values, testValue(float64(ts), "2000"))
+			} else {
+				planB.Values = append(planB.Values, testValue(float64(ts), "2000"))
+			}
+		}
+		resp := metricResp{Status: "success"}
+		resp.Data.Results = []metricRespDataResult{planA, planB}
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+	defer func() { vmselectHandler = nil }()
+
+	changes, err := detectPlanChanges(0, 30*600, 600)
+	require.NoError(t, err)
+	require.Equal(t, [][2]int{{0, 7200}, {7200, 14400}, {14400, 18000}}, ranges)
+	require.Len(t, changes, 1)
+	require.Equal(t, 7800, changes[0].ts)
+}
+
+func TestScoreAnomaly(t *testing.T) {
+	baseline := []float64{300, 310, 290, 305, 295, 300, 900}
+
+	// a surge far from the median
+	median, mad, score, ok := scoreAnomaly(6000, baseline)
+	require.True(t, ok)
+	require.Equal(t, float64(300), median)
+	require.Equal(t, float64(5), mad)
+	require.InDelta(t, 5700/(1.4826*5), score, 0.001)
+
+	// within the variation of the baseline
+	_, _, _, ok = scoreAnomaly(320, baseline)
+	require.False(t, ok)
+
+	// far from a flat baseline in units of MAD, but too little CPU time
+	_, _, _, ok = scoreAnomaly(900, []float64{0, 0, 0, 0, 0, 0})
+	require.False(t, ok)
+	_, _, _, ok = scoreAnomaly(1000, []float64{0, 0, 0, 0, 0, 0})
+	require.True(t, ok)
+
+	// too short a baseline
+	_, _, _, ok = scoreAnomaly(6000, baseline[:5])
+	require.False(t, ok)
+}
+
+func TestQueryLimits(t *testing.T) {
+	var limitErr *LimitError
+	require.NoError(t, CheckQueryRange(0, 14*24*3600, 60))
+	require.ErrorAs(t, CheckQueryRange(0, 3600, 0), &limitErr)
+	require.ErrorAs(t, CheckQueryRange(3600, 0, 60), &limitErr)
+	require.ErrorAs(t, CheckQueryRange(0, 60*24*3600, 3600), &limitErr)
+	require.ErrorAs(t, CheckQueryRange(0, 14*24*3600, 1), &limitErr)
+
+	// background queries are not limited, but still need a window
+	require.NoError(t, checkQueryRange(cpuTimeQuery{}, 0, 14*24*3600, 1))
+	require.Error(t, checkQueryRange(cpuTimeQuery{}, 0, 3600, 0))
+
+	// the heatmap is dense, so it is refused before anything is fetched
+	var heatmap HeatmapItem
+	require.ErrorAs(t, Heatmap(0, 3600, 60, 0, 0, "", "", IncludeInternal, OrderBySum, &heatmap), &limitErr)
+	require.ErrorAs(t, Heatmap(0, 3600, 60, 0, maxQueryPoints, "", "", IncludeInternal, OrderBySum, &heatmap), &limitErr)
+
+	body := []byte(`{"status":"success","data":{"resultType":"matrix","result":[` +
+		`{"metric":{"sql_digest":"a"},"values":[[60,"1"],[120,"2"]]},` +
+		`{"metric":{"sql_digest":"b"},"values":[[60,"3"]]}]}}`)
+	require.NoError(t, checkResponseSize(body))
+
+	series := bytes.Repeat([]byte(`{"metric":{},"values":[[60,"1"]]},`), maxQuerySeries+1)
+	require.ErrorAs(t, checkResponseSize(series), &limitErr)
+	points := append([]byte(`{"metric":{},"values":[[60,"1"]`), bytes.Repeat([]byte(`,[60,"1"]`), maxQueryPoints)...)
+	require.ErrorAs(t, checkResponseSize(points), &limitErr)
+
+	// vmselect gives up writing an oversized response
+	w := limitedRespWriter{ResponseWriter: utils.NewRespWriter(&bytes.Buffer{}, http.Header{})}
+	_, err := w.Write([]byte(`{"status":"success"`))
+	require.NoError(t, err)
+	_, err = w.Write(make([]byte, maxQueryResponseBytes))
+	require.Equal(t, errResponseTooLarge, err)
+	require.True(t, w.exceeded)
+}
@@ -0,0 +1,326 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/component/topsql/store"
+	"github.com/zhongzc/ng_monitoring/utils"
+
+	"github.com/genjidb/genji/document"
+	"github.com/genjidb/genji/types"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	rawMetricName   = "cpu_time"
+	rollupTableName = "topsql_rollup"
+
+	rollupInterval = time.Minute
+	// rollupDelay leaves time for the records reported late by TiDB and TiKV
+	rollupDelay = 3 * time.Minute
+	// rollupMaxRange limits the range rolled up in one round, though at least one step
+	// is rolled up, so that catching up after a long downtime is spread over rounds.
+	rollupMaxRange = time.Hour
+)
+
+type rollupLevel struct {
+	name     string
+	source   string
+	stepSecs int
+}
+
+// rollupLevels are ordered from the finest to the coarsest. Each level sums up the
+// CPU time of its source series within every step.
+var rollupLevels = []rollupLevel{
+	{name: "cpu_time_1m", source: rawMetricName, stepSecs: 60},
+	{name: "cpu_time_10m", source: "cpu_time_1m", stepSecs: 10 * 60},
+	{name: "cpu_time_1h", source: "cpu_time_10m", stepSecs: 60 * 60},
+}
+
+// rollupProgress tells the instances already rolled up for the steps ending within
+// [startSecs, endSecs] of a level, by a round failed halfway.
+type rollupProgress struct {
+	startSecs int
+	endSecs   int
+	done      map[string]bool
+}
+
+// rollupMark tells that a rollup series covers the CPU time within (firstTs, lastTs].
+// A point at ts of the series sums up the source within (ts-step, ts].
+type rollupMark struct {
+	firstTs int
+	lastTs  int
+}
+
+var (
+	rollupMu    sync.RWMutex
+	rollupMarks map[string]rollupMark
+
+	// rollupPending holds the marks rolled up in the last round. They are published in
+	// the next round, when the written points have become searchable, so that neither
+	// queries nor higher levels read a range before its points arrive.
+	rollupPending = make(map[string]rollupMark)
+	// rollupProgresses are the failed rounds by level. They are retried for the same
+	// range and skip the instances done, because the timeseries db does not dedup the
+	// points, and a point written twice would be summed up twice.
+	rollupProgresses = make(map[string]*rollupProgress)
+
+	rollupCloseCh chan struct{}
+	rollupWG      sync.WaitGroup
+)
+
+func initRollup() error {
+	sql := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (name TEXT PRIMARY KEY)", rollupTableName)
+	if err := documentDB.Exec(sql); err != nil {
+		return err
+	}
+
+	marks := make(map[string]rollupMark)
+	res, err := documentDB.Query(fmt.Sprintf("SELECT name, first_ts, last_ts FROM %s", rollupTableName))
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	err = res.Iterate(func(d types.Document) error {
+		var name string
+		var mark rollupMark
+		if err := document.Scan(d, &name, &mark.firstTs, &mark.lastTs); err != nil {
+			return err
+		}
+		marks[name] = mark
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	rollupMu.Lock()
+	rollupMarks = marks
+	rollupMu.Unlock()
+	return nil
+}
+
+func startRollup() {
+	rollupCloseCh = make(chan struct{})
+
+	rollupWG.Add(1)
+	go utils.GoWithRecovery(func() {
+		defer rollupWG.Done()
+		doRollupLoop(rollupCloseCh)
+	}, nil)
+}
+
+func stopRollup() {
+	if rollupCloseCh == nil {
+		return
+	}
+	close(rollupCloseCh)
+	rollupWG.Wait()
+
+	// the points of the pending marks are written before the marks are saved, so that
+	// they are neither rolled up again after restart, nor skipped
+	store.Flush()
+	savePendingRollupMarks()
+}
+
+func doRollupLoop(closed chan struct{}) {
+	ticker := time.NewTicker(rollupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			runRollup(time.Now())
+		case <-closed:
+			return
+		}
+	}
+}
+
+func runRollup(now time.Time) {
+	savePendingRollupMarks()
+
+	marks := make(map[string]rollupMark)
+	rollupMu.RLock()
+	for name, mark := range rollupMarks {
+		marks[name] = mark
+	}
+	rollupMu.RUnlock()
+
+	for _, level := range rollupLevels {
+		if _, ok := rollupPending[level.name]; ok {
+			continue
+		}
+
+		var target int
+		mark, ok := marks[level.name]
+		if level.source == rawMetricName {
+			target = int(now.Add(-rollupDelay).Unix())
+			target -= target % level.stepSecs
+			if !ok {
+				// the raw series is complete, start from now on
+				mark = rollupMark{firstTs: target, lastTs: target}
+			}
+		} else {
+			source, sourceOk := marks[level.source]
+			if !sourceOk {
+				continue
+			}
+			target = source.lastTs - source.lastTs%level.stepSecs
+			if !ok {
+				// start from the first step fully covered by the source
+				firstTs := source.firstTs + level.stepSecs - 1
+				firstTs -= firstTs % level.stepSecs
+				mark = rollupMark{firstTs: firstTs, lastTs: firstTs}
+			}
+		}
+
+		if target > mark.lastTs {
+			end := target
+			maxSteps := int(rollupMaxRange/time.Second) / level.stepSecs
+			if maxSteps < 1 {
+				maxSteps = 1
+			}
+			if maxEnd := mark.lastTs + level.stepSecs*maxSteps; end > maxEnd {
+				end = maxEnd
+			}
+			if progress, ok := rollupProgresses[level.name]; ok && progress.startSecs == mark.lastTs+level.stepSecs {
+				end = progress.endSecs
+			}
+			if err := rollup(level, mark.lastTs+level.stepSecs, end); err != nil {
+				log.Warn("failed to roll up cpu time", zap.String("name", level.name), zap.Error(err))
+				continue
+			}
+			mark.lastTs = end
+			rollupPending[level.name] = mark
+		} else if !ok {
+			// a new level covers nothing yet, there is no point to wait for
+			if err := saveRollupMark(level.name, mark); err != nil {
+				log.Warn("failed to save rollup progress", zap.String("name", level.name), zap.Error(err))
+			}
+		}
+	}
+}
+
+// rollup sums up the source of the level for every step ending within [startSecs, endSecs],
+// and writes the sums as the rollup series. The source is fetched instance by instance,
+// and each of them is checked against the query limits, so that a large cluster does
+// not have to be held in memory at once. The instances done are kept if any of them
+// fails, and skipped by the retry of the same range.
+func rollup(level rollupLevel, startSecs, endSecs int) error {
+	progress, ok := rollupProgresses[level.name]
+	if !ok || progress.startSecs != startSecs || progress.endSecs != endSecs {
+		progress = &rollupProgress{startSecs: startSecs, endSecs: endSecs, done: make(map[string]bool)}
+		rollupProgresses[level.name] = progress
+	}
+
+	instances, err := fetchLabelValues("instance", level.source, startSecs-level.stepSecs, endSecs)
+	if err != nil {
+		return err
+	}
+	for _, instance := range instances {
+		if progress.done[instance] {
+			continue
+		}
+		if err := rollupInstance(level, instance, startSecs, endSecs); err != nil {
+			return err
+		}
+		progress.done[instance] = true
+	}
+	delete(rollupProgresses, level.name)
+	return nil
+}
+
+func rollupInstance(level rollupLevel, instance string, startSecs, endSecs int) error {
+	// not put back to the pool, because the written metrics still refer to its labels
+	metricResponse := &metricResp{}
+	query := fmt.Sprintf("sum_over_time(%s{instance=%s}[%d])", level.source, strconv.Quote(instance), level.stepSecs)
+	if err := fetchTimeseriesDBRange(query, startSecs, endSecs, level.stepSecs, true, metricResponse); err != nil {
+		return err
+	}
+
+	for _, r := range metricResponse.Data.Results {
+		var m store.Metric
+		m.Metric.Name = level.name
+		m.Metric.Instance = r.Metric.Instance
+		m.Metric.InstanceType = r.Metric.InstanceType
+		m.Metric.SQLDigest = r.Metric.SQLDigest
+		m.Metric.PlanDigest = r.Metric.PlanDigest
+
+		for _, value := range r.Values {
+			if len(value) != 2 {
+				continue
+			}
+			cpu, err := strconv.ParseUint(value[1].(string), 10, 64)
+			if err != nil || cpu == 0 {
+				continue
+			}
+			m.Timestamps = append(m.Timestamps, uint64(value[0].(float64))*1000)
+			m.Values = append(m.Values, uint32(cpu))
+		}
+
+		if len(m.Values) != 0 {
+			store.WriteMetric(m)
+		}
+	}
+
+	return nil
+}
+
+// savePendingRollupMarks saves and publishes the marks rolled up in the last round.
+func savePendingRollupMarks() {
+	for name, mark := range rollupPending {
+		if err := saveRollupMark(name, mark); err != nil {
+			log.Warn("failed to save rollup progress", zap.String("name", name), zap.Error(err))
+			continue
+		}
+		delete(rollupPending, name)
+	}
+}
+
+func saveRollupMark(name string, mark rollupMark) error {
+	sql := fmt.Sprintf("INSERT INTO %s (name, first_ts, last_ts) VALUES (?, ?, ?) ON CONFLICT DO REPLACE", rollupTableName)
+	if err := documentDB.Exec(sql, name, mark.firstTs, mark.lastTs); err != nil {
+		return err
+	}
+
+	rollupMu.Lock()
+	rollupMarks[name] = mark
+	rollupMu.Unlock()
+	return nil
+}
+
+// pickRollupLevel picks the coarsest rollup level whose step divides the window and
+// which covers the first window of [startSecs, endSecs]. The points up to split can
+// be read from the level, and the later ones have not been rolled up yet.
+func pickRollupLevel(startSecs, endSecs, windowSecs int) (level *rollupLevel, split int) {
+	rollupMu.RLock()
+	defer rollupMu.RUnlock()
+
+	for i := len(rollupLevels) - 1; i >= 0; i-- {
+		if windowSecs%rollupLevels[i].stepSecs != 0 {
+			continue
+		}
+
+		mark, ok := rollupMarks[rollupLevels[i].name]
+		if !ok || startSecs-windowSecs < mark.firstTs {
+			continue
+		}
+
+		split = mark.lastTs - mark.lastTs%windowSecs
+		if split < startSecs {
+			continue
+		}
+		if split > endSecs {
+			split = endSecs
+		}
+		return &rollupLevels[i], split
+	}
+
+	return nil, 0
+}
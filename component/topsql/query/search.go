@@ -0,0 +1,132 @@
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/genjidb/genji/document"
+	"github.com/genjidb/genji/types"
+)
+
+// digestsPerSearchQuery limits how many digests are put into one regex matcher
+// when fetching their CPU time, so that the query keeps a reasonable size.
+const digestsPerSearchQuery = 200
+
+// SearchSQL finds the SQL digests whose SQL text matches the pattern and which
+// consumed CPU time within [startSecs, endSecs]. The results are sorted by their
+// total CPU time in descending order, and at most limit items are kept.
+func SearchSQL(startSecs, endSecs int, pattern *regexp.Regexp, limit int, fill *[]SQLSearchItem) error {
+	sqlTexts, err := matchSQLTexts(pattern)
+	if err != nil {
+		return err
+	}
+	if len(sqlTexts) == 0 {
+		return nil
+	}
+
+	digests := make([]string, 0, len(sqlTexts))
+	for digest := range sqlTexts {
+		digests = append(digests, digest)
+	}
+
+	cpuTimes, err := fetchCPUTimeByDigests(startSecs, endSecs, digests)
+	if err != nil {
+		return err
+	}
+
+	for digest, cpuTime := range cpuTimes {
+		*fill = append(*fill, SQLSearchItem{
+			SQLDigest:     digest,
+			SQLText:       sqlTexts[digest],
+			CPUTimeMillis: cpuTime,
+		})
+	}
+
+	sort.Slice(*fill, func(i, j int) bool {
+		a, b := (*fill)[i], (*fill)[j]
+		if a.CPUTimeMillis != b.CPUTimeMillis {
+			return a.CPUTimeMillis > b.CPUTimeMillis
+		}
+		return a.SQLDigest < b.SQLDigest
+	})
+	if limit > 0 && len(*fill) > limit {
+		*fill = (*fill)[:limit]
+	}
+
+	return nil
+}
+
+// matchSQLTexts finds the SQL texts matching the pattern by digest. The read transaction
+// is closed on return, so that the writers are not blocked by the timeseries queries
+// following it.
+func matchSQLTexts(pattern *regexp.Regexp) (map[string]string, error) {
+	res, err := documentDB.Query("SELECT digest, sql_text FROM sql_digest")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	sqlTexts := make(map[string]string)
+	err = res.Iterate(func(d types.Document) error {
+		var digest, sqlText string
+		if err := document.Scan(d, &digest, &sqlText); err != nil {
+			return err
+		}
+		if pattern.MatchString(sqlText) {
+			sqlTexts[digest] = sqlText
+		}
+		return nil
+	})
+	return sqlTexts, err
+}
+
+// fetchCPUTimeByDigests sums the CPU time of each SQL digest over all instances within
+// [startSecs, endSecs]. Digests without any CPU time in the range are absent from the result.
+func fetchCPUTimeByDigests(startSecs, endSecs int, digests []string) (map[string]uint64, error) {
+	rangeSecs := endSecs - startSecs
+	if rangeSecs <= 0 {
+		return nil, fmt.Errorf("end should be later than start")
+	}
+	if err := CheckQueryRange(startSecs, endSecs, rangeSecs); err != nil {
+		return nil, err
+	}
+
+	metricResponse := metricRespP.Get()
+	defer metricRespP.Put(metricResponse)
+
+	cpuTimes := make(map[string]uint64)
+	for len(digests) > 0 {
+		n := digestsPerSearchQuery
+		if n > len(digests) {
+			n = len(digests)
+		}
+		batch := digests[:n]
+		digests = digests[n:]
+
+		query := fmt.Sprintf(
+			"sum(sum_over_time(cpu_time{sql_digest=~\"%s\"}[%d])) by (sql_digest)",
+			strings.Join(batch, "|"), rangeSecs,
+		)
+		if err := fetchTimeseriesDBInstant(query, endSecs, true, metricResponse); err != nil {
+			return nil, err
+		}
+
+		for _, r := range metricResponse.Data.Results {
+			if len(r.Value) != 2 {
+				continue
+			}
+			cpu, err := strconv.ParseUint(r.Value[1].(string), 10, 64)
+			if err != nil || cpu == 0 {
+				continue
+			}
+			cpuTimes[r.Metric.SQLDigest] += cpu
+		}
+
+		metricResponse.Data.Results = metricResponse.Data.Results[:0]
+	}
+
+	return cpuTimes, nil
+}
@@ -0,0 +1,197 @@
+package service
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/zhongzc/ng_monitoring/component/topsql/query"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pingcap/log"
+	"github.com/xitongsys/parquet-go/writer"
+	"go.uber.org/zap"
+)
+
+const (
+	exportFormatCSV     = "csv"
+	exportFormatParquet = "parquet"
+
+	// parquetRowGroupSize bounds the rows buffered before they are written out
+	parquetRowGroupSize = 16 * 1024 * 1024
+)
+
+// exportWriter encodes the exported rows into a file format.
+type exportWriter interface {
+	Write(row query.ExportRow) error
+	// Close writes out everything buffered, and the footer if the format has one.
+	Close() error
+}
+
+// export streams the CPU time of every window, SQL digest and plan digest of the
+// instances in CSV or Parquet. The rows are written as soon as each instance is fetched.
+func export(c *gin.Context) {
+	format := c.DefaultQuery("format", exportFormatCSV)
+	var newWriter func(w io.Writer) (exportWriter, error)
+	var contentType string
+	switch format {
+	case exportFormatCSV:
+		newWriter = newCSVExportWriter
+		contentType = "text/csv; charset=utf-8"
+	case exportFormatParquet:
+		newWriter = newParquetExportWriter
+		contentType = "application/octet-stream"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unknown format",
+		})
+		return
+	}
+
+	var instances []string
+	for _, raw := range c.QueryArray("instance") {
+		for _, instance := range strings.Split(raw, ",") {
+			if len(instance) == 0 || strings.ContainsAny(instance, "\"\\") {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"status":  "error",
+					"message": "invalid instance",
+				})
+				return
+			}
+			instances = append(instances, instance)
+		}
+	}
+
+	params, err := parseCPUTimeParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	// the writer and the headers of the file are created on the first row, so that an
+	// error before it can still be reported as a JSON response
+	var w exportWriter
+	createWriter := func() (err error) {
+		fileName := fmt.Sprintf("topsql_%d_%d.%s", params.startSecs, params.endSecs, format)
+		c.Header("Content-Type", contentType)
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+		if w, err = newWriter(c.Writer); err != nil {
+			c.Writer.Header().Del("Content-Type")
+			c.Writer.Header().Del("Content-Disposition")
+		}
+		return err
+	}
+	emit := func(row query.ExportRow) error {
+		if w == nil {
+			if err := createWriter(); err != nil {
+				return err
+			}
+		}
+		return w.Write(row)
+	}
+
+	err = query.Export(params.startSecs, params.endSecs, params.windowSecs, instances, emit)
+	if err == nil && w == nil {
+		err = createWriter()
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		if c.Writer.Written() {
+			// abort the connection, so that the client does not take the file as complete
+			log.Warn("failed to export cpu time", zap.Error(err))
+			panic(http.ErrAbortHandler)
+		}
+		// the rows buffered by the writer have not been written yet, the error is
+		// reported as JSON instead of the file
+		c.Writer.Header().Del("Content-Type")
+		c.Writer.Header().Del("Content-Disposition")
+		c.JSON(queryErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	}
+}
+
+var exportColumns = []string{
+	"instance", "instance_type", "timestamp_secs", "sql_digest", "plan_digest", "sql_text", "cpu_time_millis",
+}
+
+type csvExportWriter struct {
+	w      *csv.Writer
+	record []string
+}
+
+func newCSVExportWriter(w io.Writer) (exportWriter, error) {
+	cw := &csvExportWriter{
+		w:      csv.NewWriter(w),
+		record: make([]string, len(exportColumns)),
+	}
+	if err := cw.w.Write(exportColumns); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *csvExportWriter) Write(row query.ExportRow) error {
+	cw.record[0] = row.Instance
+	cw.record[1] = row.InstanceType
+	cw.record[2] = strconv.FormatUint(row.TimestampSecs, 10)
+	cw.record[3] = row.SQLDigest
+	cw.record[4] = row.PlanDigest
+	cw.record[5] = row.SQLText
+	cw.record[6] = strconv.FormatUint(row.CPUTimeMillis, 10)
+	return cw.w.Write(cw.record)
+}
+
+func (cw *csvExportWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+type parquetExportRow struct {
+	Instance      string `parquet:"name=instance, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	InstanceType  string `parquet:"name=instance_type, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	TimestampSecs int64  `parquet:"name=timestamp_secs, type=INT64"`
+	SQLDigest     string `parquet:"name=sql_digest, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	PlanDigest    string `parquet:"name=plan_digest, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	SQLText       string `parquet:"name=sql_text, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	CPUTimeMillis int64  `parquet:"name=cpu_time_millis, type=INT64"`
+}
+
+type parquetExportWriter struct {
+	w *writer.ParquetWriter
+}
+
+func newParquetExportWriter(w io.Writer) (exportWriter, error) {
+	pw, err := writer.NewParquetWriterFromWriter(w, new(parquetExportRow), 1)
+	if err != nil {
+		return nil, err
+	}
+	pw.RowGroupSize = parquetRowGroupSize
+	return &parquetExportWriter{w: pw}, nil
+}
+
+func (pw *parquetExportWriter) Write(row query.ExportRow) error {
+	return pw.w.Write(parquetExportRow{
+		Instance:      row.Instance,
+		InstanceType:  row.InstanceType,
+		TimestampSecs: int64(row.TimestampSecs),
+		SQLDigest:     row.SQLDigest,
+		PlanDigest:    row.PlanDigest,
+		SQLText:       row.SQLText,
+		CPUTimeMillis: int64(row.CPUTimeMillis),
+	})
+}
+
+func (pw *parquetExportWriter) Close() error {
+	return pw.w.WriteStop()
+}
@@ -1,22 +1,57 @@
 package service
 
 import (
-	"github.com/zhongzc/ng_monitoring/component/topsql/query"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"net/http"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/zhongzc/ng_monitoring/component/topology"
+	"github.com/zhongzc/ng_monitoring/component/topsql/live"
+	"github.com/zhongzc/ng_monitoring/component/topsql/query"
+	"github.com/zhongzc/ng_monitoring/component/topsql/subscriber"
+
 	"github.com/gin-gonic/gin"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	liveRefreshInterval = time.Second
+
+	defaultHeatmapTop   = 10
+	defaultHeatmapWidth = 1000
+	maxHeatmapWidth     = 10000
 )
 
 var (
-	topSQLItemsP   = TopSQLItemsPool{}
-	instanceItemsP = InstanceItemsPool{}
+	topSQLItemsP     = TopSQLItemsPool{}
+	instanceItemsP   = InstanceItemsPool{}
+	sqlSearchItemsP  = SQLSearchItemsPool{}
+	compareItemsP    = CompareItemsPool{}
+	planChangeItemsP = PlanChangeItemsPool{}
+	anomalyItemsP    = AnomalyItemsPool{}
 )
 
 func HTTPService(g *gin.RouterGroup) {
-	g.GET("/v1/cpu_time", cpuTime)
+	g.GET("/v1/cpu_time", limitConcurrency, cpuTime)
+	g.GET("/v1/cluster/cpu_time", limitConcurrency, clusterCPUTime)
+	g.GET("/v1/export", limitConcurrency, export)
+	g.GET("/v1/heatmap", limitConcurrency, heatmap)
+	g.GET("/v1/sql/:digest", limitConcurrency, sqlDetail)
+	g.GET("/v1/sql_search", limitConcurrency, sqlSearch)
+	g.GET("/v1/compare", limitConcurrency, compare)
+	g.GET("/v1/plan_changes", planChanges)
+	g.GET("/v1/anomalies", anomalies)
+	g.GET("/v1/live", liveTopSQL)
+	g.GET("/v1/sql_text", sqlText)
 	g.GET("/v1/instances", instances)
+	g.GET("/v1/subscribers", subscribers)
 }
 
 func cpuTime(c *gin.Context) {
@@ -29,7 +64,541 @@ func cpuTime(c *gin.Context) {
 		return
 	}
 
+	params, err := parseCPUTimeParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	internal, err := parseInternalFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	orderBy, offset, err := parseRanking(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	items := topSQLItemsP.Get()
+	defer topSQLItemsP.Put(items)
+
+	var total query.TotalCPUTimeItem
+	err = query.TopSQL(params.startSecs, params.endSecs, params.windowSecs, offset, params.top, instance, internal, orderBy, items, &total)
+	if err != nil {
+		c.JSON(queryErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	resp := gin.H{
+		"status": "ok",
+		"data":   items,
+		"totals": total,
+	}
+	if params.top > 0 && offset+params.top < total.SQLDigests {
+		resp["next_offset"] = offset + params.top
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func clusterCPUTime(c *gin.Context) {
+	instanceType := c.Query("instance_type")
+	switch instanceType {
+	case "", topology.ComponentTiDB, topology.ComponentTiKV:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unknown instance type",
+		})
+		return
+	}
+
+	params, err := parseCPUTimeParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	internal, err := parseInternalFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	orderBy, offset, err := parseRanking(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	items := topSQLItemsP.Get()
+	defer topSQLItemsP.Put(items)
+
+	var total query.TotalCPUTimeItem
+	err = query.ClusterTopSQL(params.startSecs, params.endSecs, params.windowSecs, offset, params.top, instanceType, internal, orderBy, items, &total)
+	if err != nil {
+		c.JSON(queryErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	resp := gin.H{
+		"status": "ok",
+		"data":   items,
+		"totals": total,
+	}
+	if params.top > 0 && offset+params.top < total.SQLDigests {
+		resp["next_offset"] = offset + params.top
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// heatmap returns the CPU time of the top SQL digests as a matrix of about `width` buckets
+// per row. The digests of the instance are ranked if `instance` is given, otherwise those
+// of the whole cluster, or of the instances of `instance_type`.
+func heatmap(c *gin.Context) {
+	instance := c.Query("instance")
+	instanceType := c.Query("instance_type")
+	switch instanceType {
+	case "", topology.ComponentTiDB, topology.ComponentTiKV:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "unknown instance type",
+		})
+		return
+	}
+
+	params, err := parseCPUTimeParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	if len(c.Query("top")) == 0 {
+		params.top = defaultHeatmapTop
+	}
+
+	width, err := strconv.Atoi(c.DefaultQuery("width", strconv.Itoa(defaultHeatmapWidth)))
+	if err != nil || width <= 0 || width > maxHeatmapWidth {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": fmt.Sprintf("width should be within [1, %d]", maxHeatmapWidth),
+		})
+		return
+	}
+
+	internal, err := parseInternalFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	orderBy, offset, err := parseRanking(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	var item query.HeatmapItem
+	err = query.Heatmap(params.startSecs, params.endSecs, width, offset, params.top, instance, instanceType, internal, orderBy, &item)
+	if err != nil {
+		c.JSON(queryErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   item,
+	})
+}
+
+func sqlDetail(c *gin.Context) {
+	sqlDigest := c.Param("digest")
+	if _, err := hex.DecodeString(sqlDigest); err != nil || len(sqlDigest) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid sql digest",
+		})
+		return
+	}
+
+	params, err := parseCPUTimeParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	var item query.SQLDetailItem
+	err = query.SQLDetail(params.startSecs, params.endSecs, params.windowSecs, sqlDigest, &item)
+	if err != nil {
+		c.JSON(queryErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   item,
+	})
+}
+
+// sqlText looks up the SQL texts of the digests given by one or more `sql_digest`
+// parameters, each of which can also be a comma-separated list.
+func sqlText(c *gin.Context) {
+	var sqlDigests []string
+	for _, raw := range c.QueryArray("sql_digest") {
+		for _, sqlDigest := range strings.Split(raw, ",") {
+			if _, err := hex.DecodeString(sqlDigest); err != nil || len(sqlDigest) == 0 {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"status":  "error",
+					"message": "invalid sql digest",
+				})
+				return
+			}
+			sqlDigests = append(sqlDigests, sqlDigest)
+		}
+	}
+	if len(sqlDigests) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "no sql digest",
+		})
+		return
+	}
+
+	sqlTexts := make(map[string]string)
+	if err := query.SQLTexts(sqlDigests, sqlTexts); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	items := make([]query.SQLTextItem, 0, len(sqlTexts))
+	for sqlDigest, sqlText := range sqlTexts {
+		items = append(items, query.SQLTextItem{SQLDigest: sqlDigest, SQLText: sqlText})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].SQLDigest < items[j].SQLDigest
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   items,
+	})
+}
+
+func sqlSearch(c *gin.Context) {
+	var pattern *regexp.Regexp
 	var err error
+	if expr := c.Query("regex"); len(expr) != 0 {
+		pattern, err = regexp.Compile(expr)
+	} else if keyword := c.Query("keyword"); len(keyword) != 0 {
+		pattern, err = regexp.Compile("(?i)" + regexp.QuoteMeta(keyword))
+	} else {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "no keyword or regex",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	params, err := parseCPUTimeParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	items := sqlSearchItemsP.Get()
+	defer sqlSearchItemsP.Put(items)
+
+	err = query.SearchSQL(params.startSecs, params.endSecs, pattern, limit, items)
+	if err != nil {
+		c.JSON(queryErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   items,
+	})
+}
+
+func compare(c *gin.Context) {
+	var ranges [4]int
+	for i, name := range []string{"start_a", "end_a", "start_b", "end_b"} {
+		raw := c.Query(name)
+		if len(raw) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "no " + name,
+			})
+			return
+		}
+		secs, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": err.Error(),
+			})
+			return
+		}
+		ranges[i] = int(secs)
+	}
+
+	top, err := strconv.Atoi(c.DefaultQuery("top", "-1"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	items := compareItemsP.Get()
+	defer compareItemsP.Put(items)
+
+	err = query.CompareTopSQL(ranges[0], ranges[1], ranges[2], ranges[3], top, c.Query("instance"), items)
+	if err != nil {
+		c.JSON(queryErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   items,
+	})
+}
+
+func planChanges(c *gin.Context) {
+	sqlDigest := c.Query("sql_digest")
+	if _, err := hex.DecodeString(sqlDigest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid sql digest",
+		})
+		return
+	}
+
+	params, err := parseCPUTimeParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	items := planChangeItemsP.Get()
+	defer planChangeItemsP.Put(items)
+
+	if err := query.PlanChanges(params.startSecs, params.endSecs, sqlDigest, items); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   items,
+	})
+}
+
+// anomalies lists the CPU time surges detected in the background within the range, the
+// latest first, optionally only those of `instance` or `sql_digest`.
+func anomalies(c *gin.Context) {
+	instance := c.Query("instance")
+	sqlDigest := c.Query("sql_digest")
+	if _, err := hex.DecodeString(sqlDigest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "invalid sql digest",
+		})
+		return
+	}
+
+	params, err := parseCPUTimeParams(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	items := anomalyItemsP.Get()
+	defer anomalyItemsP.Put(items)
+
+	if err := query.Anomalies(params.startSecs, params.endSecs, instance, sqlDigest, items); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   items,
+	})
+}
+
+// liveTopSQL pushes the top N SQL digests of the instance within the rolling window
+// as server-sent events every liveRefreshInterval, until the client disconnects.
+func liveTopSQL(c *gin.Context) {
+	instance := c.Query("instance")
+	if len(instance) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "no instance",
+		})
+		return
+	}
+
+	top, err := strconv.Atoi(c.DefaultQuery("top", "10"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	window, err := time.ParseDuration(c.DefaultQuery("window", "1m"))
+	if err == nil && (window < time.Second || window > live.MaxWindow) {
+		err = fmt.Errorf("window should be within [1s, %s]", live.MaxWindow)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	client := live.Subscribe(instance, window)
+	defer live.Unsubscribe(client)
+
+	ticker := time.NewTicker(liveRefreshInterval)
+	defer ticker.Stop()
+
+	// cached for the whole connection, SQL texts of the same digest never change
+	sqlTexts := make(map[string]string)
+	var missing []string
+
+	c.Header("Cache-Control", "no-cache")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-client.Done():
+			return false
+		case <-c.Request.Context().Done():
+			return false
+		case now := <-ticker.C:
+			items, total := client.Top(now, top)
+
+			missing = missing[:0]
+			for _, item := range items {
+				if _, ok := sqlTexts[item.SQLDigest]; !ok {
+					missing = append(missing, item.SQLDigest)
+				}
+			}
+			if len(missing) != 0 {
+				if err := query.SQLTexts(missing, sqlTexts); err != nil {
+					log.Warn("failed to look up sql texts", zap.Error(err))
+				}
+			}
+			for i := range items {
+				items[i].SQLText = sqlTexts[items[i].SQLDigest]
+			}
+
+			c.SSEvent("top_sql", gin.H{
+				"timestamp_secs":        now.Unix(),
+				"total_cpu_time_millis": total,
+				"data":                  items,
+			})
+			return true
+		}
+	})
+}
+
+type cpuTimeParams struct {
+	startSecs  int
+	endSecs    int
+	windowSecs int
+	top        int
+}
+
+func parseCPUTimeParams(c *gin.Context) (params cpuTimeParams, err error) {
 	now := time.Now().Unix()
 
 	var startSecs float64
@@ -49,10 +618,6 @@ func cpuTime(c *gin.Context) {
 	}
 	startSecs, err = strconv.ParseFloat(raw, 64)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
 		return
 	}
 
@@ -62,10 +627,6 @@ func cpuTime(c *gin.Context) {
 	}
 	endSecs, err = strconv.ParseFloat(raw, 64)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
 		return
 	}
 
@@ -75,10 +636,6 @@ func cpuTime(c *gin.Context) {
 	}
 	top, err = strconv.ParseInt(raw, 10, 64)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"status":  "error",
-			"message": err.Error(),
-		})
 		return
 	}
 
@@ -88,37 +645,99 @@ func cpuTime(c *gin.Context) {
 	}
 	duration, err := time.ParseDuration(raw)
 	if err != nil {
+		return
+	}
+	windowSecs = int64(duration.Seconds())
+
+	params.startSecs = int(startSecs)
+	params.endSecs = int(endSecs)
+	params.windowSecs = int(windowSecs)
+	params.top = int(top)
+	return
+}
+
+// parseInternalFilter reads `include_internal`, which defaults to true, and `only_internal`,
+// which defaults to false.
+func parseInternalFilter(c *gin.Context) (query.InternalFilter, error) {
+	includeInternal, err := strconv.ParseBool(c.DefaultQuery("include_internal", "true"))
+	if err != nil {
+		return query.IncludeInternal, err
+	}
+	onlyInternal, err := strconv.ParseBool(c.DefaultQuery("only_internal", "false"))
+	if err != nil {
+		return query.IncludeInternal, err
+	}
+
+	switch {
+	case onlyInternal && !includeInternal:
+		return query.IncludeInternal, fmt.Errorf("only_internal conflicts with include_internal=false")
+	case onlyInternal:
+		return query.OnlyInternal, nil
+	case !includeInternal:
+		return query.ExcludeInternal, nil
+	default:
+		return query.IncludeInternal, nil
+	}
+}
+
+var orderByNames = map[string]query.OrderBy{
+	"sum":    query.OrderBySum,
+	"peak":   query.OrderByPeak,
+	"latest": query.OrderByLatest,
+	"growth": query.OrderByGrowth,
+}
+
+// parseRanking reads `order_by`, which defaults to sum, and `offset`, which defaults to 0.
+// The `next_offset` of the previous response can be used as the offset of the next page.
+func parseRanking(c *gin.Context) (orderBy query.OrderBy, offset int, err error) {
+	orderBy, ok := orderByNames[c.DefaultQuery("order_by", "sum")]
+	if !ok {
+		return orderBy, 0, fmt.Errorf("order_by should be sum, peak, latest or growth")
+	}
+	offset, err = strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil {
+		return orderBy, 0, err
+	}
+	if offset < 0 {
+		return orderBy, 0, fmt.Errorf("offset should not be negative")
+	}
+	return orderBy, offset, nil
+}
+
+func instances(c *gin.Context) {
+	instanceType := c.Query("instance_type")
+	switch instanceType {
+	case "", topology.ComponentTiDB, topology.ComponentTiKV:
+	default:
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": err.Error(),
+			"message": "unknown instance type",
 		})
 		return
 	}
-	windowSecs = int64(duration.Seconds())
 
-	items := topSQLItemsP.Get()
-	defer topSQLItemsP.Put(items)
-
-	err = query.TopSQL(int(startSecs), int(endSecs), int(windowSecs), int(top), instance, items)
+	now := time.Now().Unix()
+	startSecs, err := strconv.ParseFloat(c.DefaultQuery("start", "0"), 64)
 	if err != nil {
-		c.JSON(http.StatusServiceUnavailable, gin.H{
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	endSecs, err := strconv.ParseFloat(c.DefaultQuery("end", strconv.Itoa(int(now))), 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
 			"message": err.Error(),
 		})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"status": "ok",
-		"data":   items,
-	})
-}
-
-func instances(c *gin.Context) {
 	instances := instanceItemsP.Get()
 	defer instanceItemsP.Put(instances)
 
-	if err := query.AllInstances(instances); err != nil {
+	if err := query.Instances(int(startSecs), int(endSecs), instanceType, instances); err != nil {
 		c.JSON(http.StatusServiceUnavailable, gin.H{
 			"status":  "error",
 			"message": err.Error(),
@@ -131,3 +750,15 @@ func instances(c *gin.Context) {
 		"data":   instances,
 	})
 }
+
+// subscribers lists the subscribers of the TiDB and TiKV instances, and how each of
+// them is receiving the records.
+func subscribers(c *gin.Context) {
+	items := []subscriber.StatusItem{}
+	subscriber.Statuses(&items)
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   items,
+	})
+}
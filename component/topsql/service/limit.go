@@ -0,0 +1,61 @@
+package service
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/component/topsql/query"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxConcurrentQueries bounds the queries against the timeseries db in flight, so
+	// that a burst of heavy requests does not hold too much memory at the same time
+	maxConcurrentQueries = 8
+	// queries waiting longer than this for their turn are rejected
+	queryQueueTimeout = time.Second
+)
+
+var (
+	querySlots = make(chan struct{}, maxConcurrentQueries)
+
+	queriesRejected = metrics.NewCounter(`ng_monitoring_topsql_queries_rejected_total`)
+)
+
+// limitConcurrency lets the request through once one of the query slots is free, or
+// rejects it with 429 if none is freed within queryQueueTimeout.
+func limitConcurrency(c *gin.Context) {
+	timer := time.NewTimer(queryQueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case querySlots <- struct{}{}:
+	case <-timer.C:
+		queriesRejected.Inc()
+		c.Header("Retry-After", "1")
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+			"status":  "error",
+			"message": "too many queries in flight",
+		})
+		return
+	case <-c.Request.Context().Done():
+		c.Abort()
+		return
+	}
+	defer func() { <-querySlots }()
+
+	c.Next()
+}
+
+// queryErrorStatus tells 400 for the queries refused for exceeding a limit, since they
+// would never succeed, and 503 for the others.
+func queryErrorStatus(err error) int {
+	var limitErr *query.LimitError
+	if errors.As(err, &limitErr) {
+		return http.StatusBadRequest
+	}
+	return http.StatusServiceUnavailable
+}
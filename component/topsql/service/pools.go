@@ -92,3 +92,71 @@ func (iip *InstanceItemsPool) Put(iiv *[]query.InstanceItem) {
 	*iiv = (*iiv)[:0]
 	iip.p.Put(iiv)
 }
+
+type SQLSearchItemsPool struct {
+	p sync.Pool
+}
+
+func (sip *SQLSearchItemsPool) Get() *[]query.SQLSearchItem {
+	siv := sip.p.Get()
+	if siv == nil {
+		return &[]query.SQLSearchItem{}
+	}
+	return siv.(*[]query.SQLSearchItem)
+}
+
+func (sip *SQLSearchItemsPool) Put(siv *[]query.SQLSearchItem) {
+	*siv = (*siv)[:0]
+	sip.p.Put(siv)
+}
+
+type CompareItemsPool struct {
+	p sync.Pool
+}
+
+func (cip *CompareItemsPool) Get() *[]query.CompareItem {
+	civ := cip.p.Get()
+	if civ == nil {
+		return &[]query.CompareItem{}
+	}
+	return civ.(*[]query.CompareItem)
+}
+
+func (cip *CompareItemsPool) Put(civ *[]query.CompareItem) {
+	*civ = (*civ)[:0]
+	cip.p.Put(civ)
+}
+
+type PlanChangeItemsPool struct {
+	p sync.Pool
+}
+
+func (pip *PlanChangeItemsPool) Get() *[]query.PlanChangeItem {
+	piv := pip.p.Get()
+	if piv == nil {
+		return &[]query.PlanChangeItem{}
+	}
+	return piv.(*[]query.PlanChangeItem)
+}
+
+func (pip *PlanChangeItemsPool) Put(piv *[]query.PlanChangeItem) {
+	*piv = (*piv)[:0]
+	pip.p.Put(piv)
+}
+
+type AnomalyItemsPool struct {
+	p sync.Pool
+}
+
+func (aip *AnomalyItemsPool) Get() *[]query.AnomalyItem {
+	aiv := aip.p.Get()
+	if aiv == nil {
+		return &[]query.AnomalyItem{}
+	}
+	return aiv.(*[]query.AnomalyItem)
+}
+
+func (aip *AnomalyItemsPool) Put(aiv *[]query.AnomalyItem) {
+	*aiv = (*aiv)[:0]
+	aip.p.Put(aiv)
+}
@@ -0,0 +1,246 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/utils"
+
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+	"github.com/genjidb/genji/types"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	gcInterval             = 10 * time.Minute
+	lastSeenFlushInterval  = time.Minute
+	lastSeenUpdateInterval = 10 * time.Minute
+	// the instance table is small, so its record timestamps are kept more precise
+	lastRecordUpdateInterval = time.Minute
+)
+
+var (
+	retentionPeriod time.Duration
+
+	sqlDigestSeen    = newLastSeenTracker("sql_digest", "digest", "last_seen_ts", lastSeenUpdateInterval, metaBuf.forgetSQL)
+	planDigestSeen   = newLastSeenTracker("plan_digest", "digest", "last_seen_ts", lastSeenUpdateInterval, metaBuf.forgetPlan)
+	instanceSeen     = newLastSeenTracker("instance", "instance", "last_seen_ts", lastSeenUpdateInterval, nil)
+	instanceRecorded = newLastSeenTracker("instance", "instance", "last_record_ts", lastRecordUpdateInterval, nil)
+
+	gcCloseCh chan struct{}
+	gcWG      sync.WaitGroup
+)
+
+// RetentionPeriod is how long the data is kept, and is zero if kept forever.
+func RetentionPeriod() time.Duration {
+	return retentionPeriod
+}
+
+// lastSeenTracker keeps the last time each row of a meta table is referenced by
+// incoming records, and persists it into a timestamp field, e.g. `last_seen_ts`, in
+// batches. Timestamps are only persisted when they move forward by updateInterval,
+// which is precise enough to decide whether a row is out of retention.
+type lastSeenTracker struct {
+	sync.Mutex
+	table          string
+	keyField       string
+	tsField        string
+	updateInterval int64
+
+	pending   map[string]int64
+	persisted map[string]int64
+
+	// onRemove is called with the key of each row removed by gc
+	onRemove func(key string)
+}
+
+func newLastSeenTracker(
+	table, keyField, tsField string,
+	updateInterval time.Duration,
+	onRemove func(key string),
+) *lastSeenTracker {
+	return &lastSeenTracker{
+		table:          table,
+		keyField:       keyField,
+		tsField:        tsField,
+		updateInterval: int64(updateInterval / time.Second),
+		pending:        make(map[string]int64),
+		persisted:      make(map[string]int64),
+		onRemove:       onRemove,
+	}
+}
+
+func (t *lastSeenTracker) touch(key string, ts int64) {
+	t.Lock()
+	defer t.Unlock()
+
+	if ts-t.persisted[key] < t.updateInterval {
+		return
+	}
+	if ts > t.pending[key] {
+		t.pending[key] = ts
+	}
+}
+
+func (t *lastSeenTracker) flush() error {
+	t.Lock()
+	pending := t.pending
+	t.pending = make(map[string]int64)
+	t.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	sql := fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s = ?", t.table, t.tsField, t.keyField)
+	err := documentDB.Update(func(tx *genji.Tx) error {
+		stmt, err := tx.Prepare(sql)
+		if err != nil {
+			return err
+		}
+		for key, ts := range pending {
+			if err := stmt.Exec(ts, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	t.Lock()
+	for key, ts := range pending {
+		if ts > t.persisted[key] {
+			t.persisted[key] = ts
+		}
+	}
+	t.Unlock()
+	return nil
+}
+
+// gc removes the rows that have not been seen since safePointTs.
+func (t *lastSeenTracker) gc(safePointTs int64) error {
+	var removed []string
+	if t.onRemove != nil {
+		sql := fmt.Sprintf("SELECT %s FROM %s WHERE %s < ?", t.keyField, t.table, t.tsField)
+		res, err := documentDB.Query(sql, safePointTs)
+		if err != nil {
+			return err
+		}
+		err = res.Iterate(func(d types.Document) error {
+			var key string
+			if err := document.Scan(d, &key); err != nil {
+				return err
+			}
+			removed = append(removed, key)
+			return nil
+		})
+		res.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	sql := fmt.Sprintf("DELETE FROM %s WHERE %s < ?", t.table, t.tsField)
+	if err := documentDB.Exec(sql, safePointTs); err != nil {
+		return err
+	}
+	for _, key := range removed {
+		t.onRemove(key)
+	}
+
+	t.Lock()
+	for key, ts := range t.persisted {
+		if ts < safePointTs {
+			delete(t.persisted, key)
+		}
+	}
+	t.Unlock()
+	return nil
+}
+
+// backfill sets the last seen timestamp of the rows written before it was tracked,
+// which gives them a full retention period from now on.
+func (t *lastSeenTracker) backfill(ts int64) error {
+	sql := fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s IS NULL", t.table, t.tsField, t.tsField)
+	return documentDB.Exec(sql, ts)
+}
+
+func allTrackers() []*lastSeenTracker {
+	return []*lastSeenTracker{sqlDigestSeen, planDigestSeen, instanceSeen, instanceRecorded}
+}
+
+// retentionTrackers decide whether the rows are out of retention. An instance is
+// kept as long as it is connected, even though it has not sent records for a while,
+// since the subscribers touch the connected instances periodically.
+func retentionTrackers() []*lastSeenTracker {
+	return []*lastSeenTracker{sqlDigestSeen, planDigestSeen, instanceSeen}
+}
+
+func startGC() {
+	gcCloseCh = make(chan struct{})
+	gcWG.Add(1)
+	go utils.GoWithRecovery(func() {
+		defer gcWG.Done()
+		doGCLoop(gcCloseCh)
+	}, nil)
+}
+
+func stopGC() {
+	if gcCloseCh == nil {
+		return
+	}
+	close(gcCloseCh)
+	gcWG.Wait()
+	flushLastSeen()
+}
+
+func doGCLoop(closed chan struct{}) {
+	flushTicker := time.NewTicker(lastSeenFlushInterval)
+	gcTicker := time.NewTicker(gcInterval)
+	defer func() {
+		flushTicker.Stop()
+		gcTicker.Stop()
+	}()
+
+	for {
+		select {
+		case <-flushTicker.C:
+			flushLastSeen()
+		case <-gcTicker.C:
+			flushLastSeen()
+			runGC()
+		case <-closed:
+			return
+		}
+	}
+}
+
+func flushLastSeen() {
+	for _, t := range allTrackers() {
+		if err := t.flush(); err != nil {
+			log.Warn("failed to flush last seen timestamps", zap.String("table", t.table), zap.Error(err))
+		}
+	}
+}
+
+func runGC() {
+	if retentionPeriod <= 0 {
+		return
+	}
+
+	start := time.Now()
+	safePointTs := start.Add(-retentionPeriod).Unix()
+	for _, t := range retentionTrackers() {
+		if err := t.gc(safePointTs); err != nil {
+			log.Error("gc meta table failed", zap.String("table", t.table), zap.Error(err))
+		}
+	}
+	log.Info("gc meta tables finished",
+		zap.Int64("safepoint", safePointTs),
+		zap.Duration("cost", time.Since(start)))
+}
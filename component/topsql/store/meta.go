@@ -0,0 +1,262 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/utils"
+
+	"github.com/genjidb/genji"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	metaFlushInterval = 200 * time.Millisecond
+	metaFlushBatch    = 1024
+	metaRowsPerInsert = 128
+)
+
+var (
+	metaBuf = newMetaBuffer()
+
+	metaWriterCloseCh chan struct{}
+	metaWriterWG      sync.WaitGroup
+)
+
+type sqlMetaRow struct {
+	digest     string
+	sqlText    string
+	isInternal bool
+}
+
+type planMetaRow struct {
+	digest   string
+	planText string
+}
+
+// metaBuffer groups SQL and plan meta messages, and writes them with multi-row
+// inserts inside one transaction. Digests that have been written are kept in the
+// seen-sets, so that replayed messages, e.g. after a TiDB restart, are skipped.
+type metaBuffer struct {
+	sync.Mutex
+	sqlMetas  map[string]sqlMetaRow
+	planMetas map[string]planMetaRow
+	seenSQL   map[string]struct{}
+	seenPlan  map[string]struct{}
+
+	notifyCh chan struct{}
+}
+
+func newMetaBuffer() *metaBuffer {
+	return &metaBuffer{
+		sqlMetas:  make(map[string]sqlMetaRow),
+		planMetas: make(map[string]planMetaRow),
+		seenSQL:   make(map[string]struct{}),
+		seenPlan:  make(map[string]struct{}),
+		notifyCh:  make(chan struct{}, 1),
+	}
+}
+
+func (b *metaBuffer) addSQLMeta(row sqlMetaRow) {
+	b.Lock()
+	_, seen := b.seenSQL[row.digest]
+	if !seen {
+		b.sqlMetas[row.digest] = row
+	}
+	full := len(b.sqlMetas)+len(b.planMetas) >= metaFlushBatch
+	b.Unlock()
+
+	if seen {
+		sqlDigestSeen.touch(row.digest, time.Now().Unix())
+		return
+	}
+	if full {
+		b.notify()
+	}
+}
+
+func (b *metaBuffer) addPlanMeta(row planMetaRow) {
+	b.Lock()
+	_, seen := b.seenPlan[row.digest]
+	if !seen {
+		b.planMetas[row.digest] = row
+	}
+	full := len(b.sqlMetas)+len(b.planMetas) >= metaFlushBatch
+	b.Unlock()
+
+	if seen {
+		planDigestSeen.touch(row.digest, time.Now().Unix())
+		return
+	}
+	if full {
+		b.notify()
+	}
+}
+
+func (b *metaBuffer) notify() {
+	select {
+	case b.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// forgetSQL and forgetPlan drop digests removed by gc from the seen-sets.
+func (b *metaBuffer) forgetSQL(digest string) {
+	b.Lock()
+	delete(b.seenSQL, digest)
+	b.Unlock()
+}
+
+func (b *metaBuffer) forgetPlan(digest string) {
+	b.Lock()
+	delete(b.seenPlan, digest)
+	b.Unlock()
+}
+
+func (b *metaBuffer) flush() error {
+	b.Lock()
+	if len(b.sqlMetas) == 0 && len(b.planMetas) == 0 {
+		b.Unlock()
+		return nil
+	}
+	sqlRows := make([]sqlMetaRow, 0, len(b.sqlMetas))
+	for _, row := range b.sqlMetas {
+		sqlRows = append(sqlRows, row)
+	}
+	planRows := make([]planMetaRow, 0, len(b.planMetas))
+	for _, row := range b.planMetas {
+		planRows = append(planRows, row)
+	}
+	b.sqlMetas = make(map[string]sqlMetaRow)
+	b.planMetas = make(map[string]planMetaRow)
+	b.Unlock()
+
+	now := time.Now().Unix()
+	err := documentDB.Update(func(tx *genji.Tx) error {
+		if err := insertSQLMetas(tx, sqlRows, now); err != nil {
+			return err
+		}
+		return insertPlanMetas(tx, planRows, now)
+	})
+
+	b.Lock()
+	defer b.Unlock()
+	if err != nil {
+		// put them back to retry in the next round, unless newer ones have arrived
+		for _, row := range sqlRows {
+			if _, ok := b.sqlMetas[row.digest]; !ok {
+				b.sqlMetas[row.digest] = row
+			}
+		}
+		for _, row := range planRows {
+			if _, ok := b.planMetas[row.digest]; !ok {
+				b.planMetas[row.digest] = row
+			}
+		}
+		return err
+	}
+
+	for _, row := range sqlRows {
+		b.seenSQL[row.digest] = struct{}{}
+		sqlDigestSeen.touch(row.digest, now)
+	}
+	for _, row := range planRows {
+		b.seenPlan[row.digest] = struct{}{}
+		planDigestSeen.touch(row.digest, now)
+	}
+	return nil
+}
+
+func insertSQLMetas(tx *genji.Tx, rows []sqlMetaRow, now int64) error {
+	for len(rows) > 0 {
+		n := metaRowsPerInsert
+		if n > len(rows) {
+			n = len(rows)
+		}
+		batch := rows[:n]
+		rows = rows[n:]
+
+		err := insert(tx,
+			"INSERT INTO sql_digest(digest, sql_text, is_internal, last_seen_ts) VALUES ",
+			"(?, ?, ?, ?)", n,
+			" ON CONFLICT DO NOTHING",
+			func(target *[]interface{}) {
+				for _, row := range batch {
+					*target = append(*target, row.digest, row.sqlText, row.isInternal, now)
+				}
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insertPlanMetas(tx *genji.Tx, rows []planMetaRow, now int64) error {
+	for len(rows) > 0 {
+		n := metaRowsPerInsert
+		if n > len(rows) {
+			n = len(rows)
+		}
+		batch := rows[:n]
+		rows = rows[n:]
+
+		err := insert(tx,
+			"INSERT INTO plan_digest(digest, plan_text, last_seen_ts) VALUES ",
+			"(?, ?, ?)", n,
+			" ON CONFLICT DO NOTHING",
+			func(target *[]interface{}) {
+				for _, row := range batch {
+					*target = append(*target, row.digest, row.planText, now)
+				}
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func startMetaWriter() {
+	metaWriterCloseCh = make(chan struct{})
+
+	metaWriterWG.Add(1)
+	go utils.GoWithRecovery(func() {
+		defer metaWriterWG.Done()
+		doMetaWriteLoop(metaWriterCloseCh)
+	}, nil)
+}
+
+func stopMetaWriter() {
+	if metaWriterCloseCh == nil {
+		return
+	}
+	close(metaWriterCloseCh)
+	metaWriterWG.Wait()
+}
+
+func doMetaWriteLoop(closed chan struct{}) {
+	ticker := time.NewTicker(metaFlushInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if err := metaBuf.flush(); err != nil {
+			log.Warn("failed to store SQL and plan meta", zap.Error(err))
+		}
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			flush()
+		case <-metaBuf.notifyCh:
+			flush()
+		case <-closed:
+			flush()
+			return
+		}
+	}
+}
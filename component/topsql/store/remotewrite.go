@@ -0,0 +1,251 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/config"
+	"github.com/zhongzc/ng_monitoring/utils"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompbmarshal"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/promrelabel"
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/golang/snappy"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+var (
+	remoteWriteSentSamples    = metrics.NewCounter(`ng_monitoring_topsql_remote_write_sent_samples_total`)
+	remoteWriteDroppedSamples = metrics.NewCounter(`ng_monitoring_topsql_remote_write_dropped_samples_total`)
+	remoteWriteRetriesTotal   = metrics.NewCounter(`ng_monitoring_topsql_remote_write_retries_total`)
+	remoteWriteErrorsTotal    = metrics.NewCounter(`ng_monitoring_topsql_remote_write_errors_total`)
+	remoteWriteSendDuration   = metrics.NewHistogram(`ng_monitoring_topsql_remote_write_send_duration_seconds`)
+	_                         = metrics.NewGauge(`ng_monitoring_topsql_remote_write_queue_length`, func() float64 {
+		return float64(len(remoteWriteCh))
+	})
+)
+
+var (
+	// the backoff between retries doubles from remoteWriteMinBackoff up to remoteWriteMaxBackoff
+	remoteWriteMinBackoff = time.Second
+	remoteWriteMaxBackoff = 30 * time.Second
+
+	remoteWriteCh      chan Metric
+	remoteWriteCloseCh chan struct{}
+	remoteWriteWG      sync.WaitGroup
+)
+
+// remoteWriter forwards the cpu_time series to a Prometheus remote-write endpoint.
+type remoteWriter struct {
+	cfg            config.RemoteWrite
+	relabelConfigs *promrelabel.ParsedConfigs
+	client         *http.Client
+}
+
+func startRemoteWriter(cfg config.RemoteWrite) error {
+	if len(cfg.URL) == 0 {
+		return nil
+	}
+
+	w := &remoteWriter{
+		cfg:    cfg,
+		client: &http.Client{Timeout: time.Duration(cfg.TimeoutSeconds) * time.Second},
+	}
+	if len(cfg.RelabelConfig) != 0 {
+		relabelConfigs, err := promrelabel.LoadRelabelConfigs(cfg.RelabelConfig, false)
+		if err != nil {
+			return err
+		}
+		w.relabelConfigs = relabelConfigs
+	}
+
+	remoteWriteCh = make(chan Metric, cfg.QueueSize)
+	remoteWriteCloseCh = make(chan struct{})
+
+	remoteWriteWG.Add(1)
+	go utils.GoWithRecovery(func() {
+		defer remoteWriteWG.Done()
+		w.run(remoteWriteCloseCh)
+	}, nil)
+
+	log.Info("remote write enabled", zap.String("url", cfg.URL))
+	return nil
+}
+
+func stopRemoteWriter() {
+	if remoteWriteCloseCh == nil {
+		return
+	}
+	close(remoteWriteCloseCh)
+	remoteWriteWG.Wait()
+}
+
+// remoteWrite queues the metric to be forwarded if remote write is enabled. Only the
+// raw cpu_time series are forwarded, the rollups can be computed by the remote side.
+// The metric is dropped rather than blocking the write path if the queue is full.
+func remoteWrite(m Metric) {
+	if remoteWriteCh == nil || m.Metric.Name != "cpu_time" {
+		return
+	}
+	select {
+	case remoteWriteCh <- m:
+	default:
+		remoteWriteDroppedSamples.Add(len(m.Values))
+	}
+}
+
+func (w *remoteWriter) run(closed chan struct{}) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var series []prompbmarshal.TimeSeries
+	samples := 0
+	flush := func() {
+		if samples == 0 {
+			return
+		}
+		w.send(&prompbmarshal.WriteRequest{Timeseries: series}, samples, closed)
+		series = nil
+		samples = 0
+	}
+	add := func(m Metric) {
+		if ts, ok := w.toTimeSeries(m); ok {
+			series = append(series, ts)
+			samples += len(ts.Samples)
+		}
+	}
+
+	for {
+		select {
+		case m := <-remoteWriteCh:
+			add(m)
+			if samples >= w.cfg.MaxSamplesPerSend {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-closed:
+			// send what has been queued before closing, without retrying
+			for {
+				select {
+				case m := <-remoteWriteCh:
+					add(m)
+					if samples >= w.cfg.MaxSamplesPerSend {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// toTimeSeries converts the metric to a time series with relabeling applied. It returns
+// false if the series is dropped by relabeling.
+func (w *remoteWriter) toTimeSeries(m Metric) (prompbmarshal.TimeSeries, bool) {
+	labels := []prompbmarshal.Label{
+		{Name: "__name__", Value: m.Metric.Name},
+		{Name: "instance", Value: m.Metric.Instance},
+		{Name: "instance_type", Value: m.Metric.InstanceType},
+		{Name: "sql_digest", Value: m.Metric.SQLDigest},
+		{Name: "plan_digest", Value: m.Metric.PlanDigest},
+	}
+	labels = w.relabelConfigs.Apply(labels, 0, true)
+	if len(labels) == 0 {
+		remoteWriteDroppedSamples.Add(len(m.Values))
+		return prompbmarshal.TimeSeries{}, false
+	}
+
+	samples := make([]prompbmarshal.Sample, 0, len(m.Values))
+	for i, v := range m.Values {
+		samples = append(samples, prompbmarshal.Sample{
+			Value:     float64(v),
+			Timestamp: int64(m.Timestamps[i]),
+		})
+	}
+	return prompbmarshal.TimeSeries{Labels: labels, Samples: samples}, true
+}
+
+// send posts the request, and retries with backoff on network errors, 429 and 5xx
+// responses up to MaxRetries times. The request is dropped if it still fails.
+func (w *remoteWriter) send(wr *prompbmarshal.WriteRequest, samples int, closed chan struct{}) {
+	data, err := wr.Marshal()
+	if err != nil {
+		remoteWriteErrorsTotal.Inc()
+		remoteWriteDroppedSamples.Add(samples)
+		log.Warn("failed to marshal remote write request", zap.Error(err))
+		return
+	}
+	body := snappy.Encode(nil, data)
+
+	backoff := remoteWriteMinBackoff
+	for retries := 0; ; retries++ {
+		retryable, err := w.post(body)
+		if err == nil {
+			remoteWriteSentSamples.Add(samples)
+			return
+		}
+		remoteWriteErrorsTotal.Inc()
+
+		if !retryable || retries >= w.cfg.MaxRetries || isClosed(closed) {
+			remoteWriteDroppedSamples.Add(samples)
+			log.Warn("failed to remote write, dropping samples", zap.Int("samples", samples), zap.Error(err))
+			return
+		}
+
+		log.Debug("failed to remote write, retrying", zap.Duration("backoff", backoff), zap.Error(err))
+		select {
+		case <-time.After(backoff):
+		case <-closed:
+		}
+		remoteWriteRetriesTotal.Inc()
+		if backoff *= 2; backoff > remoteWriteMaxBackoff {
+			backoff = remoteWriteMaxBackoff
+		}
+	}
+}
+
+// post sends the encoded request once, and tells whether the failure is worth a retry.
+func (w *remoteWriter) post(body []byte) (retryable bool, err error) {
+	start := time.Now()
+	defer remoteWriteSendDuration.UpdateDuration(start)
+
+	req, err := http.NewRequest(http.MethodPost, w.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("unexpected status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5, err
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
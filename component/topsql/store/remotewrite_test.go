@@ -0,0 +1,114 @@
+package store
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/config"
+
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/prompb"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/require"
+)
+
+type receivedSeries struct {
+	labels     map[string]string
+	timestamps []int64
+	values     []float64
+}
+
+func TestRemoteWrite(t *testing.T) {
+	var mu sync.Mutex
+	var received []receivedSeries
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// the first request fails to make the writer retry
+		requests += 1
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		data, err := snappy.Decode(nil, body)
+		require.NoError(t, err)
+		var wr prompb.WriteRequest
+		require.NoError(t, wr.Unmarshal(data))
+
+		for _, ts := range wr.Timeseries {
+			s := receivedSeries{labels: make(map[string]string)}
+			for _, l := range ts.Labels {
+				s.labels[string(l.Name)] = string(l.Value)
+			}
+			for _, sample := range ts.Samples {
+				s.timestamps = append(s.timestamps, sample.Timestamp)
+				s.values = append(s.values, sample.Value)
+			}
+			received = append(received, s)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	relabelConfig := path.Join(t.TempDir(), "relabel.yml")
+	require.NoError(t, ioutil.WriteFile(relabelConfig, []byte(`
+- action: drop
+  source_labels: [instance]
+  regex: "tidb-1"
+- target_label: cluster
+  replacement: "test"
+`), 0644))
+
+	remoteWriteMinBackoff = 10 * time.Millisecond
+	defer func() { remoteWriteMinBackoff = time.Second }()
+
+	require.NoError(t, startRemoteWriter(config.RemoteWrite{
+		URL:               server.URL,
+		RelabelConfig:     relabelConfig,
+		QueueSize:         10,
+		MaxSamplesPerSend: 100,
+		TimeoutSeconds:    1,
+		MaxRetries:        3,
+	}))
+
+	m := Metric{Timestamps: []uint64{1000, 2000}, Values: []uint32{10, 20}}
+	m.Metric = topSQLTags{Name: "cpu_time", Instance: "tidb-0", InstanceType: "tidb", SQLDigest: "sql-a"}
+	remoteWrite(m)
+	// dropped by relabeling
+	m.Metric.Instance = "tidb-1"
+	remoteWrite(m)
+	// rollups are not forwarded
+	m.Metric = topSQLTags{Name: "cpu_time_1h", Instance: "tidb-0", InstanceType: "tidb", SQLDigest: "sql-a"}
+	remoteWrite(m)
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) != 0
+	}, 5*time.Second, 10*time.Millisecond)
+	stopRemoteWriter()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 2, requests)
+	require.Equal(t, []receivedSeries{{
+		labels: map[string]string{
+			"__name__":      "cpu_time",
+			"cluster":       "test",
+			"instance":      "tidb-0",
+			"instance_type": "tidb",
+			"sql_digest":    "sql-a",
+		},
+		timestamps: []int64{1000, 2000},
+		values:     []float64{10, 20},
+	}}, received)
+}
@@ -5,7 +5,10 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"net/http"
+	"time"
 
+	"github.com/zhongzc/ng_monitoring/component/topsql/live"
+	"github.com/zhongzc/ng_monitoring/config"
 	"github.com/zhongzc/ng_monitoring/utils"
 
 	"github.com/genjidb/genji"
@@ -25,11 +28,20 @@ var (
 	prepareSliceP  = PrepareSlicePool{}
 )
 
-func Init(vminsertHandler_ http.HandlerFunc, documentDB *genji.DB) {
+// Init initializes the store. Meta rows not referenced by any record within the
+// retention period are removed in the background.
+func Init(vminsertHandler_ http.HandlerFunc, documentDB *genji.DB, retentionPeriod_ time.Duration) {
 	vminsertHandler = vminsertHandler_
+	retentionPeriod = retentionPeriod_
 	if err := initDocumentDB(documentDB); err != nil {
 		log.Fatal("failed to create tables", zap.Error(err))
 	}
+	if err := startRemoteWriter(config.GetGlobalConfig().RemoteWrite); err != nil {
+		log.Fatal("failed to start remote write", zap.Error(err))
+	}
+	startWriter()
+	startMetaWriter()
+	startGC()
 }
 
 func initDocumentDB(db *genji.DB) error {
@@ -47,26 +59,51 @@ func initDocumentDB(db *genji.DB) error {
 		}
 	}
 
-	return nil
+	now := time.Now().Unix()
+	for _, t := range retentionTrackers() {
+		if err := t.backfill(now); err != nil {
+			return err
+		}
+	}
+
+	// the instances stored before are known to be there since their last seen time
+	return db.Exec("UPDATE instance SET first_seen_ts = last_seen_ts WHERE first_seen_ts IS NULL")
 }
 
 func Stop() {
-
+	stopWriter()
+	stopRemoteWriter()
+	stopMetaWriter()
+	stopGC()
 }
 
 func Instance(instance, instanceType string) error {
-	prepareStmt := "INSERT INTO instance(instance, instance_type) VALUES (?, ?) ON CONFLICT DO NOTHING"
+	prepareStmt := "INSERT INTO instance(instance, instance_type, first_seen_ts, last_seen_ts) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING"
 	prepare, err := documentDB.Prepare(prepareStmt)
 	if err != nil {
 		return err
 	}
 
-	return prepare.Exec(instance, instanceType)
+	now := time.Now().Unix()
+	if err := prepare.Exec(instance, instanceType, now, now); err != nil {
+		return err
+	}
+	instanceSeen.touch(instance, now)
+	return nil
+}
+
+// TouchInstance refreshes the last seen time of a connected instance, so that it is
+// not taken as out of retention even though it sends no records.
+func TouchInstance(instance string) {
+	instanceSeen.touch(instance, time.Now().Unix())
 }
 
 func TopSQLRecord(instance, instanceType string, record *tipb.CPUTimeRecord) error {
 	m := topSQLProtoToMetric(instance, instanceType, record)
-	return writeTimeseriesDB(m)
+	touchMetric(m)
+	enqueueMetric(m)
+	live.Publish(instance, m.Metric.SQLDigest, m.Timestamps, m.Values)
+	return nil
 }
 
 func ResourceMeteringRecord(
@@ -77,30 +114,49 @@ func ResourceMeteringRecord(
 	if err != nil {
 		return err
 	}
-	return writeTimeseriesDB(m)
+	touchMetric(m)
+	enqueueMetric(m)
+	live.Publish(instance, m.Metric.SQLDigest, m.Timestamps, m.Values)
+	return nil
 }
 
-func SQLMeta(meta *tipb.SQLMeta) error {
-	prepareStmt := "INSERT INTO sql_digest(digest, sql_text, is_internal) VALUES (?, ?, ?) ON CONFLICT DO NOTHING"
-	prepare, err := documentDB.Prepare(prepareStmt)
-	if err != nil {
-		return err
-	}
+// WriteMetric writes a metric derived from the stored ones, e.g. a rollup of cpu_time.
+func WriteMetric(m Metric) {
+	enqueueMetric(m)
+}
 
-	return prepare.Exec(hex.EncodeToString(meta.SqlDigest), meta.NormalizedSql, meta.IsInternalSql)
+func SQLMeta(meta *tipb.SQLMeta) error {
+	metaBuf.addSQLMeta(sqlMetaRow{
+		digest:     hex.EncodeToString(meta.SqlDigest),
+		sqlText:    meta.NormalizedSql,
+		isInternal: meta.IsInternalSql,
+	})
+	return nil
 }
 
 func PlanMeta(meta *tipb.PlanMeta) error {
-	prepareStmt := "INSERT INTO plan_digest(digest, plan_text) VALUES (?, ?) ON CONFLICT DO NOTHING"
-	prepare, err := documentDB.Prepare(prepareStmt)
-	if err != nil {
-		return err
-	}
+	metaBuf.addPlanMeta(planMetaRow{
+		digest:   hex.EncodeToString(meta.PlanDigest),
+		planText: meta.NormalizedPlan,
+	})
+	return nil
+}
 
-	return prepare.Exec(hex.EncodeToString(meta.PlanDigest), meta.NormalizedPlan)
+// touchMetric refreshes the last seen timestamps of the meta rows referenced by the metric.
+func touchMetric(m Metric) {
+	now := time.Now().Unix()
+	instanceSeen.touch(m.Metric.Instance, now)
+	instanceRecorded.touch(m.Metric.Instance, now)
+	if len(m.Metric.SQLDigest) != 0 {
+		sqlDigestSeen.touch(m.Metric.SQLDigest, now)
+	}
+	if len(m.Metric.PlanDigest) != 0 {
+		planDigestSeen.touch(m.Metric.PlanDigest, now)
+	}
 }
 
 func insert(
+	tx *genji.Tx,
 	header string, // INSERT INTO {table}({fields}...) VALUES
 	elem string, times int, // (?, ?, ... , ?), (?, ?, ... , ?), ... (?, ?, ... , ?)
 	footer string, // ON CONFLICT DO NOTHING
@@ -111,7 +167,7 @@ func insert(
 	}
 
 	prepareStmt := buildPrepareStmt(header, elem, times, footer)
-	return execStmt(prepareStmt, fill)
+	return execStmt(tx, prepareStmt, fill)
 }
 
 func buildPrepareStmt(header string, elem string, times int, footer string) string {
@@ -129,8 +185,8 @@ func buildPrepareStmt(header string, elem string, times int, footer string) stri
 	return sb.String()
 }
 
-func execStmt(prepareStmt string, fill func(target *[]interface{})) error {
-	stmt, err := documentDB.Prepare(prepareStmt)
+func execStmt(tx *genji.Tx, prepareStmt string, fill func(target *[]interface{})) error {
+	stmt, err := tx.Prepare(prepareStmt)
 	if err != nil {
 		return err
 	}
@@ -194,32 +250,6 @@ func rsMeteringProtoToMetric(
 	return
 }
 
-func writeTimeseriesDB(metric Metric) error {
-	bufReq := bytesP.Get()
-	bufResp := bytesP.Get()
-	header := headerP.Get()
-
-	defer bytesP.Put(bufReq)
-	defer bytesP.Put(bufResp)
-	defer headerP.Put(header)
-
-	if err := encodeMetric(bufReq, metric); err != nil {
-		return err
-	}
-
-	respR := utils.NewRespWriter(bufResp, header)
-	req, err := http.NewRequest("POST", "/api/v1/import", bufReq)
-	if err != nil {
-		return err
-	}
-	vminsertHandler(&respR, req)
-
-	if statusOK := respR.Code >= 200 && respR.Code < 300; !statusOK {
-		log.Warn("failed to write timeseries db", zap.String("error", respR.Body.String()))
-	}
-	return nil
-}
-
 func encodeMetric(buf *bytes.Buffer, metric Metric) error {
 	encoder := json.NewEncoder(buf)
 	return encoder.Encode(metric)
@@ -0,0 +1,177 @@
+package store
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zhongzc/ng_monitoring/utils"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	writeQueueSize     = 4096
+	flushInterval      = time.Second
+	flushBatchMetrics  = 2048
+	flushBatchMaxBytes = 4 * 1024 * 1024
+)
+
+var (
+	flushesTotal      = metrics.NewCounter(`ng_monitoring_topsql_write_flushes_total`)
+	flushErrorsTotal  = metrics.NewCounter(`ng_monitoring_topsql_write_flush_errors_total`)
+	flushedMetrics    = metrics.NewCounter(`ng_monitoring_topsql_write_flushed_metrics_total`)
+	flushedBytes      = metrics.NewCounter(`ng_monitoring_topsql_write_flushed_bytes_total`)
+	flushDuration     = metrics.NewHistogram(`ng_monitoring_topsql_write_flush_duration_seconds`)
+	flushBatchSize    = metrics.NewHistogram(`ng_monitoring_topsql_write_flush_batch_size`)
+	encodeErrorsTotal = metrics.NewCounter(`ng_monitoring_topsql_write_encode_errors_total`)
+	_                 = metrics.NewGauge(`ng_monitoring_topsql_write_queue_length`, func() float64 {
+		return float64(len(metricCh))
+	})
+)
+
+var (
+	metricCh      chan Metric
+	flushCh       chan chan struct{}
+	writerCloseCh chan struct{}
+	writerWG      sync.WaitGroup
+)
+
+func startWriter() {
+	metricCh = make(chan Metric, writeQueueSize)
+	flushCh = make(chan chan struct{})
+	writerCloseCh = make(chan struct{})
+
+	writerWG.Add(1)
+	go utils.GoWithRecovery(func() {
+		defer writerWG.Done()
+		doWriteLoop(writerCloseCh)
+	}, nil)
+}
+
+func stopWriter() {
+	if writerCloseCh == nil {
+		return
+	}
+	close(writerCloseCh)
+	writerWG.Wait()
+}
+
+// enqueueMetric hands the metric to the writer, which encodes metrics from all
+// subscribers into one buffer and imports them into the timeseries database in batches.
+func enqueueMetric(m Metric) {
+	select {
+	case metricCh <- m:
+	case <-writerCloseCh:
+	}
+}
+
+// Flush blocks until the metrics handed to the writer before are imported into the
+// timeseries database, or the writer is stopped.
+func Flush() {
+	if writerCloseCh == nil {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case flushCh <- done:
+	case <-writerCloseCh:
+		return
+	}
+	select {
+	case <-done:
+	case <-writerCloseCh:
+	}
+}
+
+func doWriteLoop(closed chan struct{}) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	buf := bytesP.Get()
+	defer bytesP.Put(buf)
+
+	count := 0
+	flush := func() {
+		if count == 0 {
+			return
+		}
+		writeTimeseriesDB(buf, count)
+		buf.Reset()
+		count = 0
+	}
+	// drain encodes what has been queued so far
+	drain := func() {
+		for {
+			select {
+			case m := <-metricCh:
+				if err := encodeMetric(buf, m); err == nil {
+					remoteWrite(m)
+					count += 1
+				}
+			default:
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case m := <-metricCh:
+			if err := encodeMetric(buf, m); err != nil {
+				encodeErrorsTotal.Inc()
+				log.Warn("failed to encode metric", zap.Error(err))
+				continue
+			}
+			remoteWrite(m)
+			count += 1
+			if count >= flushBatchMetrics || buf.Len() >= flushBatchMaxBytes {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case done := <-flushCh:
+			drain()
+			flush()
+			close(done)
+		case <-closed:
+			// drain what has been queued before closing
+			drain()
+			flush()
+			return
+		}
+	}
+}
+
+func writeTimeseriesDB(buf *bytes.Buffer, count int) {
+	start := time.Now()
+	defer flushDuration.UpdateDuration(start)
+
+	flushesTotal.Inc()
+	flushedMetrics.Add(count)
+	flushedBytes.Add(buf.Len())
+	flushBatchSize.Update(float64(count))
+
+	bufResp := bytesP.Get()
+	header := headerP.Get()
+
+	defer bytesP.Put(bufResp)
+	defer headerP.Put(header)
+
+	respR := utils.NewRespWriter(bufResp, header)
+	req, err := http.NewRequest("POST", "/api/v1/import", buf)
+	if err != nil {
+		flushErrorsTotal.Inc()
+		log.Warn("failed to build import request", zap.Error(err))
+		return
+	}
+	vminsertHandler(&respR, req)
+
+	if statusOK := respR.Code >= 200 && respR.Code < 300; !statusOK {
+		flushErrorsTotal.Inc()
+		log.Warn("failed to write timeseries db", zap.String("error", respR.Body.String()))
+	}
+}
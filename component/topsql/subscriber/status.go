@@ -0,0 +1,69 @@
+package subscriber
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/zhongzc/ng_monitoring/component/topology"
+)
+
+// StatusItem tells how a subscriber is doing. The times are unix seconds, and 0 if
+// never happened. The counts are summed up over all streams since it is set up.
+type StatusItem struct {
+	Instance     string `json:"instance"`
+	InstanceType string `json:"instance_type"`
+	State        string `json:"state"`
+	// ConnectTimeSecs is when the latest stream was set up
+	ConnectTimeSecs    int64  `json:"connect_time_secs"`
+	LastRecordTimeSecs int64  `json:"last_record_time_secs"`
+	Records            uint64 `json:"records"`
+	SQLMetas           uint64 `json:"sql_metas"`
+	PlanMetas          uint64 `json:"plan_metas"`
+	LastErrorTimeSecs  int64  `json:"last_error_time_secs"`
+	LastError          string `json:"last_error"`
+}
+
+// Statuses fills the status of every subscriber, sorted by instance.
+func Statuses(fill *[]StatusItem) {
+	if globalManager == nil {
+		return
+	}
+
+	globalManager.mu.RLock()
+	for _, s := range globalManager.components {
+		*fill = append(*fill, s.Status())
+	}
+	globalManager.mu.RUnlock()
+
+	sort.Slice(*fill, func(i, j int) bool {
+		a, b := (*fill)[i], (*fill)[j]
+		if a.Instance != b.Instance {
+			return a.Instance < b.Instance
+		}
+		return a.InstanceType < b.InstanceType
+	})
+}
+
+func (s *Subscriber) Status() StatusItem {
+	return StatusItem{
+		Instance:           s.addr(),
+		InstanceType:       s.component.Name,
+		State:              s.State().String(),
+		ConnectTimeSecs:    s.connectTime.Load(),
+		LastRecordTimeSecs: s.lastRecordTime.Load(),
+		Records:            s.records.Load(),
+		SQLMetas:           s.sqlMetas.Load(),
+		PlanMetas:          s.planMetas.Load(),
+		LastErrorTimeSecs:  s.lastErrorTime.Load(),
+		LastError:          s.lastError.Load(),
+	}
+}
+
+// addr is the address to subscribe to, which is also the instance the records are
+// stored with.
+func (s *Subscriber) addr() string {
+	if s.component.Name == topology.ComponentTiDB {
+		return fmt.Sprintf("%s:%d", s.component.IP, s.component.StatusPort)
+	}
+	return fmt.Sprintf("%s:%d", s.component.IP, s.component.Port)
+}
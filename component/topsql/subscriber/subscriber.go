@@ -2,14 +2,17 @@ package subscriber
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"sync"
 	"time"
 
 	"github.com/zhongzc/ng_monitoring/component/topology"
 	"github.com/zhongzc/ng_monitoring/component/topsql/store"
 	"github.com/zhongzc/ng_monitoring/config"
+	"github.com/zhongzc/ng_monitoring/config/pdvariable"
 	"github.com/zhongzc/ng_monitoring/utils"
 
 	"github.com/pingcap/kvproto/pkg/resource_usage_agent"
@@ -24,21 +27,33 @@ import (
 
 var (
 	dialTimeout = 5 * time.Second
+
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = 30 * time.Second
+
+	// the connected instances are touched this often, so that the idle ones are kept
+	instanceTouchInterval = time.Minute
+
+	errStreamClosed = errors.New("stream closed by the component")
 )
 
 var (
-	globalStopCh chan struct{}
-	scraperWG    sync.WaitGroup
+	globalStopCh  chan struct{}
+	scraperWG     sync.WaitGroup
+	globalManager *Manager
 )
 
 func Init(topoSubscriber topology.Subscriber) {
 	globalStopCh = make(chan struct{})
+	globalManager = &Manager{
+		topoSubscriber: topoSubscriber,
+		varSubscriber:  pdvariable.SubscribeChange(),
+	}
 
 	scraperWG.Add(1)
 	go utils.GoWithRecovery(func() {
 		defer scraperWG.Done()
-		sm := Manager{topoSubscriber: topoSubscriber}
-		sm.run()
+		globalManager.run()
 	}, nil)
 }
 
@@ -49,59 +64,129 @@ func Stop() {
 	log.Info("stop subscribers successfully")
 }
 
+// Manager keeps a subscriber for every TiDB and TiKV instance of the topology, as long
+// as TopSQL is enabled by the PD variable.
 type Manager struct {
 	topoSubscriber topology.Subscriber
-	components     map[topology.Component]*Subscriber
+	varSubscriber  chan struct{}
+
+	// the latest topology, and whether TopSQL is enabled, only accessed by run
+	lastComponents []topology.Component
+	enabled        bool
+
+	// components is only changed by run, and mu guards the reads from other goroutines
+	mu         sync.RWMutex
+	components map[topology.Component]*Subscriber
 }
 
 func (m *Manager) run() {
+	m.mu.Lock()
 	m.components = make(map[topology.Component]*Subscriber)
+	m.mu.Unlock()
+	m.enabled = pdvariable.GetPDVariable().EnableTopSQL
+	log.Info("TopSQL subscribers are set up", zap.Bool("enabled", m.enabled))
 	defer func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
 		for _, v := range m.components {
 			v.Close()
 		}
 		m.components = nil
 	}()
 
+	touchTicker := time.NewTicker(instanceTouchInterval)
+	defer touchTicker.Stop()
+
 out:
 	for {
 		select {
 		case coms := <-m.topoSubscriber:
-			// clean up closed subscribers
-			for component, subscriber := range m.components {
-				if subscriber.IsDown() {
-					subscriber.Close()
-					delete(m.components, component)
-				}
-			}
+			m.update(coms)
+		case <-m.varSubscriber:
+			m.updateEnabled()
+		case <-touchTicker.C:
+			m.touchInstances()
+		case <-globalStopCh:
+			break out
+		}
+	}
+}
 
-			if len(coms) == 0 {
-				log.Warn("got empty components. Seems to be encountering network problems")
-				continue
-			}
+// touchInstances refreshes the last seen time of the instances streaming, which may
+// send no records for long if idle.
+func (m *Manager) touchInstances() {
+	for _, subscriber := range m.components {
+		if subscriber.State() == StateStreaming {
+			store.TouchInstance(subscriber.addr())
+		}
+	}
+}
 
-			in, out := m.getTopoChange(coms)
+func (m *Manager) update(coms []topology.Component) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-			// clean up stale components
-			for i := range out {
-				m.components[out[i]].Close()
-				delete(m.components, out[i])
-			}
+	// clean up closed subscribers
+	for component, subscriber := range m.components {
+		if subscriber.IsDown() {
+			subscriber.Close()
+			delete(m.components, component)
+		}
+	}
+
+	if len(coms) == 0 {
+		log.Warn("got empty components. Seems to be encountering network problems")
+		return
+	}
+	m.lastComponents = coms
+	if !m.enabled {
+		return
+	}
 
-			// set up incoming components
-			for i := range in {
-				subscriber := NewSubscriber(in[i])
-				m.components[in[i]] = subscriber
+	in, out := m.getTopoChange(coms)
 
-				scraperWG.Add(1)
-				go utils.GoWithRecovery(func() {
-					defer scraperWG.Done()
-					subscriber.run()
-				}, nil)
-			}
-		case <-globalStopCh:
-			break out
+	// clean up stale components
+	for i := range out {
+		m.components[out[i]].Close()
+		delete(m.components, out[i])
+	}
+
+	// set up incoming components
+	for i := range in {
+		subscriber := NewSubscriber(in[i])
+		m.components[in[i]] = subscriber
+
+		scraperWG.Add(1)
+		go utils.GoWithRecovery(func() {
+			defer scraperWG.Done()
+			subscriber.run()
+		}, nil)
+	}
+}
+
+// updateEnabled subscribes to all components of the latest topology once TopSQL is
+// enabled, and closes all subscribers once it is disabled.
+func (m *Manager) updateEnabled() {
+	enabled := pdvariable.GetPDVariable().EnableTopSQL
+	if enabled == m.enabled {
+		return
+	}
+	m.enabled = enabled
+
+	if enabled {
+		log.Info("TopSQL is enabled, start subscribing to the components")
+		if len(m.lastComponents) != 0 {
+			m.update(m.lastComponents)
 		}
+		return
+	}
+
+	log.Info("TopSQL is disabled, stop subscribing to the components")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for component, subscriber := range m.components {
+		subscriber.Close()
+		delete(m.components, component)
 	}
 }
 
@@ -131,17 +216,61 @@ func (m *Manager) getTopoChange(current []topology.Component) (in, out []topolog
 	return
 }
 
+// State tells what a subscriber is doing.
+type State int32
+
+const (
+	// StateConnecting means the subscriber is dialing the component and subscribing to it.
+	StateConnecting State = iota
+	// StateStreaming means the records are being received.
+	StateStreaming
+	// StateBackingOff means the subscriber is waiting to reconnect after the stream broke.
+	StateBackingOff
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateStreaming:
+		return "streaming"
+	case StateBackingOff:
+		return "backing-off"
+	default:
+		return "unknown"
+	}
+}
+
 type Subscriber struct {
 	isDown    *atomic.Bool
+	state     *atomic.Int32
 	component topology.Component
 	closeCh   chan struct{}
+
+	// the health of the streams, see StatusItem
+	connectTime    *atomic.Int64
+	lastRecordTime *atomic.Int64
+	records        *atomic.Uint64
+	sqlMetas       *atomic.Uint64
+	planMetas      *atomic.Uint64
+	lastErrorTime  *atomic.Int64
+	lastError      *atomic.String
 }
 
 func NewSubscriber(component topology.Component) *Subscriber {
 	return &Subscriber{
 		isDown:    atomic.NewBool(false),
+		state:     atomic.NewInt32(int32(StateConnecting)),
 		component: component,
 		closeCh:   make(chan struct{}),
+
+		connectTime:    atomic.NewInt64(0),
+		lastRecordTime: atomic.NewInt64(0),
+		records:        atomic.NewUint64(0),
+		sqlMetas:       atomic.NewUint64(0),
+		planMetas:      atomic.NewUint64(0),
+		lastErrorTime:  atomic.NewInt64(0),
+		lastError:      atomic.NewString(""),
 	}
 }
 
@@ -149,30 +278,82 @@ func (s *Subscriber) IsDown() bool {
 	return s.isDown.Load()
 }
 
+func (s *Subscriber) State() State {
+	return State(s.state.Load())
+}
+
 func (s *Subscriber) Close() {
 	close(s.closeCh)
 }
 
+func (s *Subscriber) isClosed() bool {
+	select {
+	case <-globalStopCh:
+		return true
+	case <-s.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// run scrapes the component until the subscriber is closed. Whenever the stream breaks,
+// it reconnects after a backoff.
 func (s *Subscriber) run() {
 	defer s.isDown.Store(true)
 	log.Info("starting to scrape top SQL from the component", zap.Any("component", s.component))
 
+	var scrape func() error
 	switch s.component.Name {
 	case topology.ComponentTiDB:
-		s.scrapeTiDB()
+		scrape = s.scrapeTiDB
 	case topology.ComponentTiKV:
-		s.scrapeTiKV()
+		scrape = s.scrapeTiKV
 	default:
 		log.Error("unexpected scrape target", zap.String("component", s.component.Name))
+		return
+	}
+
+	var bo reconnectBackoff
+	for {
+		s.state.Store(int32(StateConnecting))
+		startTime := time.Now()
+		err := scrape()
+		if s.isClosed() {
+			return
+		}
+
+		// a stream lasting long enough is taken as recovered
+		if time.Since(startTime) >= reconnectMaxBackoff {
+			bo.reset()
+		}
+		s.lastErrorTime.Store(time.Now().Unix())
+		s.lastError.Store(err.Error())
+		delay := bo.next()
+		log.Warn("failed to scrape top SQL from the component, reconnect later",
+			zap.Any("component", s.component), zap.Duration("backoff", delay), zap.Error(err))
+
+		s.state.Store(int32(StateBackingOff))
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-globalStopCh:
+			timer.Stop()
+			return
+		case <-s.closeCh:
+			timer.Stop()
+			return
+		}
 	}
 }
 
-func (s *Subscriber) scrapeTiDB() {
-	addr := fmt.Sprintf("%s:%d", s.component.IP, s.component.StatusPort)
+// scrapeTiDB receives the records until the stream breaks, or the subscriber is closed,
+// in which case nil is returned.
+func (s *Subscriber) scrapeTiDB() error {
+	addr := s.addr()
 	conn, err := dial(addr)
 	if err != nil {
-		log.Error("failed to dial scrape target", zap.Any("component", s.component), zap.Error(err))
-		return
+		return fmt.Errorf("failed to dial scrape target: %w", err)
 	}
 	defer conn.Close()
 
@@ -182,30 +363,30 @@ func (s *Subscriber) scrapeTiDB() {
 	client := tipb.NewTopSQLPubSubClient(conn)
 	stream, err := client.Subscribe(ctx, &tipb.TopSQLSubRequest{})
 	if err != nil {
-		log.Error("failed to call Subscribe", zap.Any("component", s.component), zap.Error(err))
-		return
+		return fmt.Errorf("failed to call Subscribe: %w", err)
 	}
+	s.connected()
 
-	stopCh := make(chan struct{})
+	errCh := make(chan error, 1)
 	go utils.GoWithRecovery(func() {
-		defer close(stopCh)
-
 		if err := store.Instance(addr, topology.ComponentTiDB); err != nil {
-			log.Warn("failed to store instance", zap.Error(err))
+			errCh <- fmt.Errorf("failed to store instance: %w", err)
 			return
 		}
 
 		for {
 			r, err := stream.Recv()
 			if err == io.EOF {
-				break
+				errCh <- errStreamClosed
+				return
 			}
 			if err != nil {
-				log.Warn("failed to receive records from stream", zap.Error(err))
-				break
+				errCh <- fmt.Errorf("failed to receive records from stream: %w", err)
+				return
 			}
 
 			if record := r.GetRecord(); record != nil {
+				s.received()
 				err = store.TopSQLRecord(addr, topology.ComponentTiDB, record)
 				if err != nil {
 					log.Warn("failed to store top SQL records", zap.Error(err))
@@ -214,6 +395,7 @@ func (s *Subscriber) scrapeTiDB() {
 			}
 
 			if meta := r.GetSqlMeta(); meta != nil {
+				s.sqlMetas.Inc()
 				err = store.SQLMeta(meta)
 				if err != nil {
 					log.Warn("failed to store SQL meta", zap.Error(err))
@@ -222,27 +404,32 @@ func (s *Subscriber) scrapeTiDB() {
 			}
 
 			if meta := r.GetPlanMeta(); meta != nil {
+				s.planMetas.Inc()
 				err = store.PlanMeta(meta)
 				if err != nil {
 					log.Warn("failed to store SQL meta", zap.Error(err))
 				}
 			}
 		}
-	}, nil)
+	}, recoverToErr(errCh))
 
 	select {
 	case <-globalStopCh:
-	case <-stopCh:
+		return nil
 	case <-s.closeCh:
+		return nil
+	case err := <-errCh:
+		return err
 	}
 }
 
-func (s *Subscriber) scrapeTiKV() {
-	addr := fmt.Sprintf("%s:%d", s.component.IP, s.component.Port)
+// scrapeTiKV is the same as scrapeTiDB, except that it subscribes to the resource
+// metering records of TiKV.
+func (s *Subscriber) scrapeTiKV() error {
+	addr := s.addr()
 	conn, err := dial(addr)
 	if err != nil {
-		log.Error("failed to dial scrape target", zap.Any("component", s.component), zap.Error(err))
-		return
+		return fmt.Errorf("failed to dial scrape target: %w", err)
 	}
 	defer conn.Close()
 
@@ -252,41 +439,85 @@ func (s *Subscriber) scrapeTiKV() {
 	client := resource_usage_agent.NewResourceMeteringPubSubClient(conn)
 	records, err := client.Subscribe(ctx, &resource_usage_agent.ResourceMeteringRequest{})
 	if err != nil {
-		log.Error("failed to call SubCPUTimeRecord", zap.Any("component", s.component), zap.Error(err))
-		return
+		return fmt.Errorf("failed to call SubCPUTimeRecord: %w", err)
 	}
+	s.connected()
 
-	stopCh := make(chan struct{})
+	errCh := make(chan error, 1)
 	go utils.GoWithRecovery(func() {
-		defer close(stopCh)
-
 		if err := store.Instance(addr, topology.ComponentTiKV); err != nil {
-			log.Warn("failed to store instance", zap.Error(err))
+			errCh <- fmt.Errorf("failed to store instance: %w", err)
 			return
 		}
 
 		for {
 			r, err := records.Recv()
 			if err == io.EOF {
-				break
+				errCh <- errStreamClosed
+				return
 			}
 			if err != nil {
-				log.Warn("failed to receive records from stream", zap.Error(err))
-				break
+				errCh <- fmt.Errorf("failed to receive records from stream: %w", err)
+				return
 			}
 
+			s.received()
 			err = store.ResourceMeteringRecord(addr, topology.ComponentTiKV, r)
 			if err != nil {
 				log.Warn("failed to store resource metering records", zap.Error(err))
 			}
 		}
-	}, nil)
+	}, recoverToErr(errCh))
 
 	select {
 	case <-globalStopCh:
-	case <-stopCh:
+		return nil
 	case <-s.closeCh:
+		return nil
+	case err := <-errCh:
+		return err
+	}
+}
+
+func (s *Subscriber) connected() {
+	s.connectTime.Store(time.Now().Unix())
+	s.state.Store(int32(StateStreaming))
+}
+
+func (s *Subscriber) received() {
+	s.lastRecordTime.Store(time.Now().Unix())
+	s.records.Inc()
+}
+
+// recoverToErr reports the panic of the goroutine receiving records, so that the
+// subscriber does not wait for it forever.
+func recoverToErr(errCh chan<- error) func(r interface{}) {
+	return func(r interface{}) {
+		if r != nil {
+			errCh <- fmt.Errorf("panic while receiving records: %v", r)
+		}
+	}
+}
+
+// reconnectBackoff doubles the delay after every failure in a row, from
+// reconnectMinBackoff up to reconnectMaxBackoff. Only the first half of the delay is
+// fixed and the rest is random, so that the subscribers of a restarted cluster do not
+// reconnect all at once.
+type reconnectBackoff struct {
+	failures int
+}
+
+func (b *reconnectBackoff) next() time.Duration {
+	delay := reconnectMaxBackoff
+	if b.failures < 32 && reconnectMinBackoff<<b.failures < reconnectMaxBackoff {
+		delay = reconnectMinBackoff << b.failures
 	}
+	b.failures++
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func (b *reconnectBackoff) reset() {
+	b.failures = 0
 }
 
 func dial(addr string) (*grpc.ClientConn, error) {
@@ -0,0 +1,27 @@
+package subscriber
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	var bo reconnectBackoff
+	for _, delay := range []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second,
+		30 * time.Second, 30 * time.Second,
+	} {
+		d := bo.next()
+		require.GreaterOrEqual(t, d, delay/2)
+		require.LessOrEqual(t, d, delay)
+	}
+
+	bo.reset()
+	require.LessOrEqual(t, bo.next(), time.Second)
+
+	// never overflows after failing for a long time
+	bo.failures = 100
+	require.GreaterOrEqual(t, bo.next(), 15*time.Second)
+}
@@ -2,8 +2,10 @@ package topsql
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/zhongzc/ng_monitoring/component/topology"
+	"github.com/zhongzc/ng_monitoring/component/topsql/live"
 	"github.com/zhongzc/ng_monitoring/component/topsql/query"
 	"github.com/zhongzc/ng_monitoring/component/topsql/store"
 	"github.com/zhongzc/ng_monitoring/component/topsql/subscriber"
@@ -11,14 +13,15 @@ import (
 	"github.com/genjidb/genji"
 )
 
-func Init(gj *genji.DB, insertHdr, selectHdr http.HandlerFunc, subsbr topology.Subscriber) {
-	store.Init(insertHdr, gj)
+func Init(gj *genji.DB, insertHdr, selectHdr http.HandlerFunc, subsbr topology.Subscriber, retentionPeriod time.Duration) {
+	store.Init(insertHdr, gj, retentionPeriod)
 	query.Init(selectHdr, gj)
 	subscriber.Init(subsbr)
 }
 
 func Stop() {
+	live.Stop()
 	subscriber.Stop()
-	store.Stop()
 	query.Stop()
+	store.Stop()
 }
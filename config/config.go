@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	stdlog "log"
+	"net/url"
 	"path"
 	"sort"
 	"strings"
@@ -25,6 +26,11 @@ const (
 	DefProfileSeconds                = 10
 	DefProfilingTimeoutSeconds       = 120
 	DefProfilingDataRetentionSeconds = 3 * 24 * 60 * 60 // 3 days
+
+	DefRemoteWriteQueueSize         = 10000
+	DefRemoteWriteMaxSamplesPerSend = 2000
+	DefRemoteWriteTimeoutSeconds    = 30
+	DefRemoteWriteMaxRetries        = 5
 )
 
 type Config struct {
@@ -35,6 +41,7 @@ type Config struct {
 	Storage           Storage                 `toml:"storage" json:"storage"`
 	ContinueProfiling ContinueProfilingConfig `toml:"-" json:"continuous-profiling"`
 	Security          Security                `toml:"security" json:"security"`
+	RemoteWrite       RemoteWrite             `toml:"remote-write" json:"remote-write"`
 }
 
 var defaultConfig = Config{
@@ -56,6 +63,12 @@ var defaultConfig = Config{
 		TimeoutSeconds:       DefProfilingTimeoutSeconds,
 		DataRetentionSeconds: DefProfilingDataRetentionSeconds,
 	},
+	RemoteWrite: RemoteWrite{
+		QueueSize:         DefRemoteWriteQueueSize,
+		MaxSamplesPerSend: DefRemoteWriteMaxSamplesPerSend,
+		TimeoutSeconds:    DefRemoteWriteTimeoutSeconds,
+		MaxRetries:        DefRemoteWriteMaxRetries,
+	},
 }
 
 var globalConf atomic.Value
@@ -131,6 +144,10 @@ func (c *Config) valid() error {
 		return err
 	}
 
+	if err = c.RemoteWrite.valid(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -158,6 +175,41 @@ func (s *Storage) valid() error {
 	return nil
 }
 
+// RemoteWrite configures forwarding the TopSQL cpu_time series to a Prometheus
+// remote-write endpoint. It is disabled if the URL is empty.
+type RemoteWrite struct {
+	URL string `toml:"url" json:"url"`
+	// RelabelConfig is the path to a file of Prometheus relabel configs applied to each series before sending
+	RelabelConfig     string `toml:"relabel-config" json:"relabel-config"`
+	QueueSize         int    `toml:"queue-size" json:"queue-size"`
+	MaxSamplesPerSend int    `toml:"max-samples-per-send" json:"max-samples-per-send"`
+	TimeoutSeconds    int    `toml:"timeout-seconds" json:"timeout-seconds"`
+	MaxRetries        int    `toml:"max-retries" json:"max-retries"`
+}
+
+func (r *RemoteWrite) valid() error {
+	if len(r.URL) == 0 {
+		return nil
+	}
+
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return fmt.Errorf("invalid remote write url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("remote write url should start with http:// or https://, got %s", r.URL)
+	}
+
+	if r.QueueSize <= 0 || r.MaxSamplesPerSend <= 0 || r.TimeoutSeconds <= 0 {
+		return fmt.Errorf("remote write queue-size, max-samples-per-send and timeout-seconds should be positive")
+	}
+	if r.MaxRetries < 0 {
+		return fmt.Errorf("remote write max-retries should not be negative")
+	}
+
+	return nil
+}
+
 type Log struct {
 	Path  string `toml:"path" json:"path"`
 	Level string `toml:"level" json:"level"`
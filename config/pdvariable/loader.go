@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pingcap/log"
@@ -21,16 +23,24 @@ const (
 	defaultRetryInterval = time.Millisecond * 200
 )
 
-var loader *PDVariableLoader
+var (
+	loader *PDVariableLoader
+
+	changeSubscribersMu sync.Mutex
+	changeSubscribers   []chan struct{}
+)
 
 type PDVariableLoader struct {
-	cli    *clientv3.Client
-	cfg    *PDVariable
+	cli *clientv3.Client
+	// cfg holds a *PDVariable, which is replaced as a whole on change
+	cfg    atomic.Value
 	cancel context.CancelFunc
 }
 
+// PDVariable is the global variables of the cluster. The variables not set in PD take
+// the same defaults as TiDB, which are the zero values.
 type PDVariable struct {
-	EnableTopSQL bool
+	EnableTopSQL bool `json:"enable-topsql"`
 }
 
 func Init(cli *clientv3.Client) {
@@ -41,8 +51,44 @@ func Init(cli *clientv3.Client) {
 	return
 }
 
+// GetPDVariable returns the latest variables, which must not be modified.
 func GetPDVariable() *PDVariable {
-	return loader.cfg
+	if loader != nil {
+		if cfg, ok := loader.cfg.Load().(*PDVariable); ok {
+			return cfg
+		}
+	}
+	return &PDVariable{}
+}
+
+// SubscribeChange returns a channel notified whenever the variables change.
+func SubscribeChange() chan struct{} {
+	// buffered, so that a change during handling the previous one is not missed
+	ch := make(chan struct{}, 1)
+	changeSubscribersMu.Lock()
+	changeSubscribers = append(changeSubscribers, ch)
+	changeSubscribersMu.Unlock()
+	return ch
+}
+
+func notifyChange() {
+	changeSubscribersMu.Lock()
+	defer changeSubscribersMu.Unlock()
+	for _, ch := range changeSubscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (g *PDVariableLoader) update(cfg *PDVariable) {
+	old := GetPDVariable()
+	g.cfg.Store(cfg)
+	if *old != *cfg {
+		log.Info("global config changed", zap.Reflect("cfg", cfg))
+		notifyChange()
+	}
 }
 
 func (g *PDVariableLoader) start() {
@@ -60,12 +106,12 @@ func Stop() {
 func (g *PDVariableLoader) loadGlobalConfigLoop(ctx context.Context) {
 	ticker := time.NewTicker(time.Minute)
 	watchCh := g.cli.Watch(ctx, globalConfigPath, clientv3.WithPrefix())
-	var err error
-	g.cfg, err = g.loadAllGlobalConfig(ctx)
+	cfg, err := g.loadAllGlobalConfig(ctx)
 	if err != nil {
 		log.Error("first load global config failed", zap.Error(err))
 	} else {
-		log.Info("first load global config", zap.Reflect("global-config", g.cfg))
+		log.Info("first load global config", zap.Reflect("global-config", cfg))
+		g.update(cfg)
 	}
 	for {
 		select {
@@ -75,30 +121,26 @@ func (g *PDVariableLoader) loadGlobalConfigLoop(ctx context.Context) {
 			cfg, err := g.loadAllGlobalConfig(ctx)
 			if err != nil {
 				log.Error("load global config failed", zap.Error(err))
-			} else if cfg != nil {
-				if g.cfg == nil && *g.cfg != *cfg {
-					g.cfg = cfg
-					log.Info("load global config", zap.Reflect("cfg", g.cfg))
-				}
+			} else {
+				g.update(cfg)
 			}
 		case e, ok := <-watchCh:
 			if !ok {
 				log.Info("global config watch channel closed")
 				watchCh = g.cli.Watch(ctx, globalConfigPath, clientv3.WithPrefix())
 			} else {
-				if g.cfg == nil {
-					g.cfg = &PDVariable{}
-				}
+				// parsed into a copy, since the current one may be being read
+				cfg := *GetPDVariable()
 				for _, event := range e.Events {
 					if event.Type != mvccpb.PUT {
 						continue
 					}
-					err = g.parseGlobalConfig(string(event.Kv.Key), string(event.Kv.Value), g.cfg)
+					err = g.parseGlobalConfig(string(event.Kv.Key), string(event.Kv.Value), &cfg)
 					if err != nil {
 						log.Error("load global config failed", zap.Error(err))
 					}
-					log.Info("watch global config changed", zap.Reflect("cfg", g.cfg))
 				}
+				g.update(&cfg)
 			}
 		}
 	}
@@ -121,9 +163,6 @@ func (g *PDVariableLoader) loadAllGlobalConfig(ctx context.Context) (*PDVariable
 			time.Sleep(defaultRetryInterval)
 			continue
 		}
-		if len(resp.Kvs) == 0 {
-			return nil, nil
-		}
 		cfg := PDVariable{}
 		for _, kv := range resp.Kvs {
 			err = g.parseGlobalConfig(string(kv.Key), string(kv.Value), &cfg)
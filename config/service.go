@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/pingcap/log"
+	"github.com/zhongzc/ng_monitoring/config/pdvariable"
 	"go.uber.org/zap"
 	"net/http"
 )
@@ -15,9 +16,14 @@ func HTTPService(g *gin.RouterGroup) {
 	g.POST("", handlePostConfig)
 }
 
+// handleGetConfig returns the config, together with the PD variables which are read
+// only, e.g. whether TopSQL is enabled.
 func handleGetConfig(c *gin.Context) {
 	cfg := GetGlobalConfig()
-	c.JSON(http.StatusOK, cfg)
+	c.JSON(http.StatusOK, struct {
+		*Config
+		PDVariable *pdvariable.PDVariable `json:"pd-variable"`
+	}{cfg, pdvariable.GetPDVariable()})
 }
 
 func handlePostConfig(c *gin.Context) {
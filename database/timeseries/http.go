@@ -0,0 +1,28 @@
+package timeseries
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// HTTPService exposes the read-only part of the Prometheus querying API, so that tools
+// like Grafana can use the group as a Prometheus data source.
+func HTTPService(g *gin.RouterGroup) {
+	for _, path := range []string{"/api/v1/query", "/api/v1/query_range", "/api/v1/series", "/api/v1/labels"} {
+		g.GET(path, selectPath(path))
+		g.POST(path, selectPath(path))
+	}
+	g.GET("/api/v1/label/:name/values", labelValues)
+}
+
+// selectPath serves the request by vmselect as if it were requested at path, which
+// drops the prefix of the group.
+func selectPath(path string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.URL.Path = path
+		SelectHandler(c.Writer, c.Request)
+	}
+}
+
+func labelValues(c *gin.Context) {
+	selectPath("/api/v1/label/" + c.Param("name") + "/values")(c)
+}
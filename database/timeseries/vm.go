@@ -13,6 +13,7 @@ import (
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect/promql"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmstorage"
+	"github.com/VictoriaMetrics/VictoriaMetrics/lib/flagutil"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/fs"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/logger"
 	"github.com/VictoriaMetrics/VictoriaMetrics/lib/storage"
@@ -45,6 +46,19 @@ func Init(cfg *config.Config) {
 	logger.Infof("started VictoriaMetrics in %.3f seconds", time.Since(startTime).Seconds())
 }
 
+// RetentionPeriod returns the period after which the data is automatically deleted.
+func RetentionPeriod() time.Duration {
+	f := flag.Lookup("retentionPeriod")
+	if f == nil {
+		return 0
+	}
+	d, ok := f.Value.(*flagutil.Duration)
+	if !ok {
+		return 0
+	}
+	return time.Duration(d.Msecs) * time.Millisecond
+}
+
 func Stop() {
 	startTime := time.Now()
 	vminsert.Stop()
@@ -71,7 +71,7 @@ func main() {
 	pdvariable.Init(topology.GetEtcdClient())
 	defer pdvariable.Stop()
 
-	topsql.Init(document.Get(), timeseries.InsertHandler, timeseries.SelectHandler, topology.Subscribe())
+	topsql.Init(document.Get(), timeseries.InsertHandler, timeseries.SelectHandler, topology.Subscribe(), timeseries.RetentionPeriod())
 	defer topsql.Stop()
 
 	err = conprof.Init(document.Get(), topology.Subscribe())
@@ -9,7 +9,9 @@ import (
 	conprofhttp "github.com/zhongzc/ng_monitoring/component/conprof/http"
 	topsqlsvc "github.com/zhongzc/ng_monitoring/component/topsql/service"
 	"github.com/zhongzc/ng_monitoring/config"
+	"github.com/zhongzc/ng_monitoring/database/timeseries"
 
+	"github.com/VictoriaMetrics/metrics"
 	"github.com/gin-contrib/gzip"
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
@@ -32,19 +34,31 @@ func ServeHTTP(l *config.Log, listener net.Listener) {
 	}
 	ng.Use(gin.LoggerWithWriter(file))
 
-	// recovery
-	ng.Use(gin.Recovery())
+	// recovery, except for the aborted handlers, which are left to net/http to abort the
+	// connection, so that the clients see the responses failed halfway as incomplete
+	ng.Use(gin.CustomRecovery(func(c *gin.Context, err interface{}) {
+		if err == http.ErrAbortHandler {
+			panic(err)
+		}
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}))
 
-	// gzip
-	ng.Use(gzip.Gzip(gzip.DefaultCompression))
+	// gzip, except for streaming responses which the gzip writer can't flush
+	ng.Use(gzip.Gzip(gzip.DefaultCompression, gzip.WithExcludedPaths([]string{"/topsql/v1/live"})))
 
 	// route
 	configGroup := ng.Group("/config")
 	config.HTTPService(configGroup)
 	topSQLGroup := ng.Group("/topsql")
 	topsqlsvc.HTTPService(topSQLGroup)
+	timeseriesGroup := ng.Group("/timeseries")
+	timeseries.HTTPService(timeseriesGroup)
 	// register pprof http api
 	pprof.Register(ng)
+	// expose metrics of ng monitoring itself in prometheus format
+	ng.GET("/metrics", func(c *gin.Context) {
+		metrics.WritePrometheus(c.Writer, true)
+	})
 
 	continuousProfilingGroup := ng.Group("/continuous_profiling")
 	conprofhttp.HTTPService(continuousProfilingGroup)